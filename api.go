@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The versioned API under /api/v1 serves the registration, NFT and program
+// flows to the mobile apps. Requests carry JSON bodies (query parameters for
+// GET) and every response uses one envelope:
+//
+//	{"ok": true, "data": {...}}
+//	{"ok": false, "error": {"code": "order_not_matched", "message": "...", "fields": {"email": "required"}, "details": {"reference": "..."}}}
+//
+// Routes are described once in a table that drives the validation of the
+// parameters and the OpenAPI document served at /api/v1/openapi.json. The
+// handlers are the ones behind the form endpoints; their responses are put
+// into the envelope.
+
+const (
+	apiPrefix      = "/api/v1"
+	maxAPIBodySize = 64 << 10
+)
+
+// apiRoute describes an API endpoint.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// Params are read from the JSON body, or from the query for GET.
+	Params []apiParam
+	// Data documents the fields of a successful response.
+	Data []apiParam
+	// Errors lists the error codes the endpoint answers with, besides the
+	// ones every endpoint can answer with.
+	Errors []string
+	// Form passes the parameters to the handler as form values.
+	Form    bool
+	Handler http.HandlerFunc
+}
+
+// apiParam is a string unless Type says otherwise.
+type apiParam struct {
+	Name        string
+	Type        string
+	Required    bool
+	Description string
+}
+
+type apiError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Details map[string]any    `json:"details,omitempty"`
+}
+
+type apiEnvelope struct {
+	OK    bool      `json:"ok"`
+	Data  any       `json:"data,omitempty"`
+	Error *apiError `json:"error,omitempty"`
+}
+
+// apiCommonErrors can be answered by every endpoint. They include every code
+// of apiStatusCodes, since any handler may answer with a bare status.
+var apiCommonErrors = []string{"invalid_request", "invalid_json", "unauthorized", "forbidden", "not_found", "method_not_allowed", "conflict", "body_too_large", "unsupported_media_type", "rate_limited", "unavailable", "internal_error"}
+
+// apiStatusCodes are the error codes used when a handler gives none.
+var apiStatusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// apiRoutes holds the routes added by other parts of the server, such as the
+// programs, before registerAPI is called.
+var apiRoutes []apiRoute
+
+// writeJSON answers with a JSON body.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeJSONError answers with the error body used by the form endpoints.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"status": "error", "code": code, "message": message})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	if e.Code == "" {
+		e.Code = apiStatusCodes[status]
+		if e.Code == "" {
+			e.Code = "internal_error"
+		}
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	writeJSON(w, status, apiEnvelope{Error: &e})
+}
+
+func coreAPIRoutes() []apiRoute {
+	verificationErrors := []string{"invalid_phone", "order_not_matched", "order_refunded", "amount_too_low"}
+	walletErrors := []string{"signature_required", "nonce_invalid", "signature_invalid", "invalid_address", "delegation_invalid", "delegation_required", "nft_check_unavailable"}
+	nftParams := []apiParam{
+		{Name: "address", Required: true, Description: "Wallet that signed the challenge"},
+		{Name: "appId", Required: true},
+		{Name: "tokenAccountId", Required: true},
+		{Name: "nonce", Description: "Nonce of the challenge from /nft/challenge"},
+		{Name: "signature", Description: "personal_sign signature of the challenge message"},
+		{Name: "vault", Description: "Wallet holding the NFTs when address is its delegate"},
+		{Name: "delegationSignature", Description: "Signature of the delegation message by the vault"},
+	}
+	return []apiRoute{
+		{
+			Method:  "POST",
+			Path:    "/register",
+			Summary: "Fund an account with a verified order",
+			Form:    true,
+			Params: []apiParam{
+				{Name: "appId", Required: true},
+				{Name: "tokenAccountId", Required: true},
+				{Name: "email", Description: "Email of the order, not needed by apps that do not verify orders"},
+				{Name: "orderId"},
+				{Name: "phoneNumber", Description: "At least the last 4 digits of the shipping phone"},
+				{Name: "challengeId", Description: "One-time code challenge from a 202 response"},
+				{Name: "otpCode"},
+				{Name: "lang", Description: "Language of the emails"},
+			},
+			Data: []apiParam{
+				{Name: "message"},
+				{Name: "code", Description: "otp_required when a one-time code was sent (status 202)"},
+				{Name: "channel"},
+				{Name: "challengeId"},
+			},
+			Errors: append([]string{"invalid_app", "not_entitled", "account_limit_reached", "account_already_registered", "funding_failed",
+				"otp_unavailable", "otp_no_destination", "otp_resend_throttled", "otp_send_failed", "otp_invalid", "otp_expired", "otp_too_many_attempts", "otp_not_found"},
+				verificationErrors...),
+			Handler: registerHandler,
+		},
+		{
+			Method:  "POST",
+			Path:    "/nft/challenge",
+			Summary: "Get the message a wallet signs to prove control",
+			Params: []apiParam{
+				{Name: "address", Required: true},
+				{Name: "tokenAccountId", Required: true},
+				{Name: "vault", Description: "Wallet holding the NFTs when address is its delegate"},
+			},
+			Data: []apiParam{
+				{Name: "nonce"},
+				{Name: "message"},
+				{Name: "expiresAt"},
+				{Name: "delegationMessage", Description: "Message for the vault to sign, when vault is given and has no active delegation to address"},
+				{Name: "delegationExpiresAt", Description: "When the delegation ends once signed"},
+			},
+			Errors:  []string{"invalid_address"},
+			Handler: nftChallengeHandler,
+		},
+		{
+			Method:  "POST",
+			Path:    "/nft/delegation/revoke",
+			Summary: "Revoke a delegation signed by a vault",
+			Params: []apiParam{
+				{Name: "vault", Required: true},
+				{Name: "delegate", Required: true},
+				{Name: "signature", Description: "Signature of the revocation message by the vault; without it the message is returned"},
+			},
+			Data: []apiParam{
+				{Name: "revocationMessage", Description: "Message for the vault to sign, when no signature is given"},
+				{Name: "message"},
+			},
+			Errors:  []string{"invalid_address", "delegation_not_found", "signature_invalid"},
+			Handler: nftDelegationRevokeHandler,
+		},
+		{
+			Method:  "POST",
+			Path:    "/nft/verify",
+			Summary: "Check whether a wallet holds an eligible NFT",
+			Params:  nftParams,
+			Data: []apiParam{
+				{Name: "hasNFT", Type: "boolean"},
+				{Name: "collection"},
+				{Name: "claimable", Type: "boolean"},
+			},
+			Errors:  walletErrors,
+			Handler: verifyNFTHandler,
+		},
+		{
+			Method:  "POST",
+			Path:    "/nft/fund",
+			Summary: "Fund an account with an NFT",
+			Params:  append(append([]apiParam{}, nftParams...), apiParam{Name: "email", Description: "Address for the confirmation email"}),
+			Data:    []apiParam{{Name: "message"}},
+			Errors: append([]string{"nft_not_owned", "wallet_already_registered", "account_already_registered", "nft_already_claimed", "funding_failed"},
+				walletErrors...),
+			Handler: verifyNFTAndFundHandler,
+		},
+	}
+}
+
+// registerAPI serves the API routes and their OpenAPI document.
+func registerAPI() {
+	routes := append(coreAPIRoutes(), apiRoutes...)
+	byPath := make(map[string][]apiRoute)
+	for _, route := range routes {
+		byPath[route.Path] = append(byPath[route.Path], route)
+	}
+	for path, routes := range byPath {
+		http.HandleFunc(apiPrefix+path, apiHandler(routes))
+	}
+	document := openAPIDocument(routes)
+	http.HandleFunc(apiPrefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, document)
+	})
+	http.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, apiError{Message: "No such endpoint"})
+	})
+}
+
+func apiHandler(routes []apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var methods []string
+		for _, route := range routes {
+			if route.Method == r.Method {
+				route.serve(w, r)
+				return
+			}
+			methods = append(methods, route.Method)
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, apiError{})
+	}
+}
+
+// serve validates the parameters, passes the request on to the handler in
+// the form it expects and puts its response into the envelope.
+func (route apiRoute) serve(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]any)
+	var body []byte
+	if route.Method == "GET" {
+		for name, values := range r.URL.Query() {
+			params[name] = values[0]
+		}
+	} else {
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/json" {
+				writeAPIError(w, http.StatusUnsupportedMediaType, apiError{Message: "Requests must have a JSON body."})
+				return
+			}
+		}
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, apiError{Message: "The request body is too large."})
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiError{Message: "The request body could not be read."})
+			return
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			body = []byte("{}")
+		}
+		if err := json.Unmarshal(body, &params); err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiError{Code: "invalid_json", Message: "The request body must be a JSON object."})
+			return
+		}
+	}
+
+	fields := make(map[string]string)
+	for _, p := range route.Params {
+		value, present := params[p.Name]
+		switch {
+		case !present || value == nil || value == "":
+			if p.Required {
+				fields[p.Name] = "required"
+			}
+		case p.Type == "boolean":
+			if _, ok := value.(bool); !ok {
+				fields[p.Name] = "must be a boolean"
+			}
+		default:
+			if _, ok := value.(string); !ok {
+				fields[p.Name] = "must be a string"
+			}
+		}
+	}
+	if len(fields) > 0 {
+		writeAPIError(w, http.StatusBadRequest, apiError{Message: "Some fields are missing or invalid.", Fields: fields})
+		return
+	}
+
+	inner := r.Clone(r.Context())
+	switch {
+	case route.Form:
+		values := url.Values{}
+		for name, value := range params {
+			if s, ok := value.(string); ok {
+				values.Set(name, s)
+			}
+		}
+		encoded := values.Encode()
+		inner.Body = io.NopCloser(strings.NewReader(encoded))
+		inner.ContentLength = int64(len(encoded))
+		inner.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	case body != nil:
+		inner.Body = io.NopCloser(bytes.NewReader(body))
+		inner.ContentLength = int64(len(body))
+	}
+	recorder := &apiRecorder{header: make(http.Header)}
+	route.Handler(recorder, inner)
+	recorder.writeEnvelope(w)
+}
+
+// apiRecorder keeps the response of a handler so it can be put into the
+// envelope.
+type apiRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *apiRecorder) Header() http.Header { return rec.header }
+
+func (rec *apiRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *apiRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// writeEnvelope translates the handler's response. JSON bodies with
+// "status": "error" become errors, with "field" as a field error and the
+// remaining keys as details; plain text bodies from http.Error become errors
+// coded by their status.
+func (rec *apiRecorder) writeEnvelope(w http.ResponseWriter) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	for name, values := range rec.header {
+		if name != "Content-Type" && name != "Content-Length" && name != "X-Content-Type-Options" {
+			w.Header()[name] = values
+		}
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(rec.body.Bytes(), &body); err != nil {
+		message := strings.TrimSpace(rec.body.String())
+		if status < 400 {
+			writeJSON(w, status, apiEnvelope{OK: true, Data: map[string]any{"message": message}})
+			return
+		}
+		writeAPIError(w, status, apiError{Message: message})
+		return
+	}
+
+	if status >= 400 || body["status"] == "error" {
+		if status < 400 {
+			status = http.StatusBadRequest
+		}
+		e := apiError{}
+		e.Code, _ = body["code"].(string)
+		e.Message, _ = body["message"].(string)
+		if field, _ := body["field"].(string); field != "" {
+			e.Fields = map[string]string{field: e.Message}
+		}
+		for name, value := range body {
+			switch name {
+			case "status", "code", "message", "field":
+				continue
+			}
+			if e.Details == nil {
+				e.Details = make(map[string]any)
+			}
+			e.Details[name] = value
+		}
+		writeAPIError(w, status, e)
+		return
+	}
+	delete(body, "status")
+	writeJSON(w, status, apiEnvelope{OK: true, Data: body})
+}
+
+// openAPIDocument describes the routes as an OpenAPI 3 document.
+func openAPIDocument(routes []apiRoute) map[string]any {
+	paths := make(map[string]map[string]any)
+	allCodes := map[string]bool{}
+	for _, route := range routes {
+		codes := append(append([]string{}, route.Errors...), apiCommonErrors...)
+		sort.Strings(codes)
+		for _, code := range codes {
+			allCodes[code] = true
+		}
+		operation := map[string]any{
+			"summary":     route.Summary,
+			"operationId": strings.ToLower(route.Method) + strings.NewReplacer("/", "_", "-", "_").Replace(route.Path),
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "Success",
+					"content": map[string]any{"application/json": map[string]any{"schema": map[string]any{
+						"type":     "object",
+						"required": []string{"ok", "data"},
+						"properties": map[string]any{
+							"ok":   map[string]any{"type": "boolean", "enum": []bool{true}},
+							"data": openAPIObject(route.Data),
+						},
+					}}},
+				},
+				"default": map[string]any{
+					"description": "Error, with one of the codes: " + strings.Join(codes, ", "),
+					"content": map[string]any{"application/json": map[string]any{"schema": map[string]any{
+						"$ref": "#/components/schemas/ErrorResponse",
+					}}},
+				},
+			},
+		}
+		if route.Method == "GET" {
+			var parameters []map[string]any
+			for _, p := range route.Params {
+				parameters = append(parameters, map[string]any{
+					"name":        p.Name,
+					"in":          "query",
+					"required":    p.Required,
+					"description": p.Description,
+					"schema":      map[string]any{"type": openAPIType(p)},
+				})
+			}
+			operation["parameters"] = parameters
+		} else {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": openAPIObject(route.Params)}},
+			}
+		}
+		if paths[apiPrefix+route.Path] == nil {
+			paths[apiPrefix+route.Path] = make(map[string]any)
+		}
+		paths[apiPrefix+route.Path][strings.ToLower(route.Method)] = operation
+	}
+
+	var codes []string
+	for code := range allCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "testnet-server API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{"schemas": map[string]any{
+			"ErrorResponse": map[string]any{
+				"type":     "object",
+				"required": []string{"ok", "error"},
+				"properties": map[string]any{
+					"ok": map[string]any{"type": "boolean", "enum": []bool{false}},
+					"error": map[string]any{
+						"type":     "object",
+						"required": []string{"code", "message"},
+						"properties": map[string]any{
+							"code":    map[string]any{"type": "string", "enum": codes},
+							"message": map[string]any{"type": "string"},
+							"fields": map[string]any{
+								"type":                 "object",
+								"description":          "Problems with individual parameters, by name",
+								"additionalProperties": map[string]any{"type": "string"},
+							},
+							"details": map[string]any{
+								"type":        "object",
+								"description": "Further information such as a support reference or a challengeId",
+							},
+						},
+					},
+				},
+			},
+		}},
+	}
+}
+
+func openAPIObject(params []apiParam) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+	for _, p := range params {
+		property := map[string]any{"type": openAPIType(p)}
+		if p.Description != "" {
+			property["description"] = p.Description
+		}
+		properties[p.Name] = property
+		if p.Required {
+			required = append(required, p.Name)
+		}
+	}
+	object := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+func openAPIType(p apiParam) string {
+	if p.Type == "" {
+		return "string"
+	}
+	return p.Type
+}
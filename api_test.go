@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestOpenAPIErrorCodes(t *testing.T) {
+	doc := openAPIDocument(coreAPIRoutes())
+	schema := doc["components"].(map[string]any)["schemas"].(map[string]any)["ErrorResponse"].(map[string]any)
+	code := schema["properties"].(map[string]any)["error"].(map[string]any)["properties"].(map[string]any)["code"].(map[string]any)
+	published := map[string]bool{}
+	for _, c := range code["enum"].([]string) {
+		published[c] = true
+	}
+	for status, c := range apiStatusCodes {
+		if !published[c] {
+			t.Errorf("code %s for status %d is not published", c, status)
+		}
+	}
+	if !published["internal_error"] {
+		t.Error("internal_error is not published")
+	}
+}
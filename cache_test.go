@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTTLCacheEvictsOldest(t *testing.T) {
+	c := newTTLCache[int](time.Hour)
+	for i := 0; i < maxCacheEntries+10; i++ {
+		c.Set(strconv.Itoa(i), i)
+		// Expiry times have to differ to tell the oldest apart
+		c.entries[strconv.Itoa(i)] = cacheEntry[int]{value: i, expires: time.Now().Add(time.Hour + time.Duration(i)*time.Millisecond)}
+	}
+	if len(c.entries) != maxCacheEntries {
+		t.Errorf("cache holds %d entries; want %d", len(c.entries), maxCacheEntries)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := c.Get(strconv.Itoa(i)); ok {
+			t.Errorf("entry %d not evicted", i)
+		}
+	}
+	if v, ok := c.Get(strconv.Itoa(maxCacheEntries + 9)); !ok || v != maxCacheEntries+9 {
+		t.Errorf("newest entry = %d, %t", v, ok)
+	}
+	// Replacing a cached key evicts nothing
+	c.Set("10", -1)
+	if _, ok := c.Get("11"); !ok || len(c.entries) != maxCacheEntries {
+		t.Error("entry evicted when replacing a cached key")
+	}
+}
+
+func TestTTLCacheExpires(t *testing.T) {
+	c := newTTLCache[string](time.Hour)
+	c.Set("jane@example.com", "1001")
+	if v, ok := c.Get("jane@example.com"); !ok || v != "1001" {
+		t.Errorf("Get = %q, %t", v, ok)
+	}
+	c.entries["jane@example.com"] = cacheEntry[string]{value: "1001", expires: time.Now().Add(-time.Second)}
+	if _, ok := c.Get("jane@example.com"); ok {
+		t.Error("expired entry returned")
+	}
+	c = newTTLCache[string](0)
+	c.Set("a", "b")
+	if len(c.entries) != 0 {
+		t.Error("cache without TTL stores entries")
+	}
+}
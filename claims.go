@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClaimKeyType says what made a registration eligible. The key is recorded
+// separately from the funded account so limits can be enforced on both. The
+// NFT tokens used by wallet claims are recorded in nftClaims.jsonl.
+type ClaimKeyType string
+
+const (
+	ClaimOrder  ClaimKeyType = "order"
+	ClaimWallet ClaimKeyType = "wallet"
+)
+
+// Claim is one funded registration, stored as a line of userDetails.txt:
+// "timestamp, key, tokenAccountID, appId, keyType".
+type Claim struct {
+	Time           string
+	KeyType        ClaimKeyType
+	Key            string
+	TokenAccountID string
+	AppID          string
+}
+
+// parseClaim reads a userDetails.txt line. Lines written before the key type
+// column existed hold an order number, or a wallet address for NFT
+// registrations.
+func parseClaim(line string) (Claim, bool) {
+	parts := strings.Split(line, ", ")
+	if len(parts) < 4 {
+		return Claim{}, false
+	}
+	claim := Claim{
+		Time:           parts[0],
+		Key:            strings.TrimSpace(parts[1]),
+		TokenAccountID: parts[2],
+		AppID:          parts[3],
+		KeyType:        ClaimOrder,
+	}
+	if len(parts) >= 5 {
+		claim.KeyType = ClaimKeyType(strings.TrimSpace(parts[4]))
+	} else if validAddress(strings.ToLower(claim.Key)) {
+		claim.KeyType = ClaimWallet
+	}
+	return claim, true
+}
+
+func normalizeClaimKey(keyType ClaimKeyType, key string) string {
+	if keyType == ClaimWallet {
+		return strings.ToLower(strings.TrimSpace(key))
+	}
+	return strings.TrimSpace(key)
+}
+
+// readClaims calls fn for every recorded claim.
+func readClaims(fn func(Claim)) {
+	file, err := os.Open(userDetailFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error opening file:", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if claim, ok := parseClaim(scanner.Text()); ok {
+			fn(claim)
+		}
+	}
+}
+
+var (
+	errClaimKeyLimit  = errors.New("the key has funded its maximum number of accounts")
+	errAccountClaimed = errors.New("the account is already registered for the app")
+)
+
+// claimStore serializes the claim checks and writes. A claim is reserved
+// before funding and counted while pending, so concurrent requests cannot
+// both pass the limits; it is then saved or released.
+type claimStore struct {
+	mu      sync.Mutex
+	pending map[*Claim]bool
+}
+
+var claims = &claimStore{pending: make(map[*Claim]bool)}
+
+// reserve checks that the account has no claim for the app and that the key
+// has fewer than keyLimit claims, for the app or for any app when anyApp is
+// set. A negative keyLimit means no limit. It returns the reserved claim and
+// the number of claims the key already has.
+func (s *claimStore) reserve(claim Claim, keyLimit int, anyApp bool) (*Claim, int, error) {
+	claim.Key = normalizeClaimKey(claim.KeyType, claim.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keyClaims, accountClaimed := 0, false
+	count := func(c Claim) {
+		if c.KeyType == claim.KeyType && strings.EqualFold(c.Key, claim.Key) && (anyApp || c.AppID == claim.AppID) {
+			keyClaims++
+		}
+		if c.TokenAccountID == claim.TokenAccountID && c.AppID == claim.AppID {
+			accountClaimed = true
+		}
+	}
+	readClaims(count)
+	for c := range s.pending {
+		count(*c)
+	}
+	if keyLimit >= 0 && keyClaims >= keyLimit {
+		return nil, keyClaims, errClaimKeyLimit
+	}
+	if accountClaimed {
+		return nil, keyClaims, errAccountClaimed
+	}
+	reserved := &claim
+	s.pending[reserved] = true
+	return reserved, keyClaims, nil
+}
+
+// release gives up a reserved claim whose funding failed.
+func (s *claimStore) release(claim *Claim) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, claim)
+}
+
+// save appends a claim to userDetails.txt, ending its reservation if any.
+func (s *claimStore) save(claim *Claim) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, claim)
+
+	timestamp := time.Now().Format(time.RFC3339) // Get current date/time
+	record := fmt.Sprintf("%s, %s, %s, %s, %s\n", timestamp, normalizeClaimKey(claim.KeyType, claim.Key), claim.TokenAccountID, claim.AppID, claim.KeyType)
+
+	file, err := os.OpenFile(userDetailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error opening file:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(record); err != nil {
+		log.Println("Error writing to file:", err)
+	}
+}
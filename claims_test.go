@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestClaimReservations(t *testing.T) {
+	inTempDir(t)
+	s := &claimStore{pending: make(map[*Claim]bool)}
+	order := func(account, app string) Claim {
+		return Claim{KeyType: ClaimOrder, Key: "1001", TokenAccountID: account, AppID: app}
+	}
+
+	first, funded, err := s.reserve(order("acc1", "main"), 2, true)
+	if err != nil || funded != 0 {
+		t.Fatalf("first reserve = %d, %v", funded, err)
+	}
+	// A pending claim counts against both limits
+	if _, _, err := s.reserve(order("acc1", "main"), 2, true); err != errAccountClaimed {
+		t.Errorf("same account while pending: %v", err)
+	}
+	second, funded, err := s.reserve(order("acc2", "main"), 2, true)
+	if err != nil || funded != 1 {
+		t.Fatalf("second reserve = %d, %v", funded, err)
+	}
+	if _, _, err := s.reserve(order("acc3", "main"), 2, true); err != errClaimKeyLimit {
+		t.Errorf("third account: %v", err)
+	}
+
+	// A released claim frees its slot; saved claims are read back
+	s.release(second)
+	s.save(first)
+	if _, funded, err := s.reserve(order("acc3", "main"), 2, true); err != nil || funded != 1 {
+		t.Errorf("after release = %d, %v", funded, err)
+	}
+	if _, _, err := s.reserve(order("acc1", "main"), -1, true); err != errAccountClaimed {
+		t.Errorf("saved account: %v", err)
+	}
+	if _, _, err := s.reserve(Claim{KeyType: ClaimWallet, Key: "0xABC", TokenAccountID: "acc1", AppID: "other"}, 1, false); err != nil {
+		t.Errorf("another app: %v", err)
+	}
+}
+
+func TestClaimReservationsConcurrent(t *testing.T) {
+	inTempDir(t)
+	s := &claimStore{pending: make(map[*Claim]bool)}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			claim, _, err := s.reserve(Claim{KeyType: ClaimWallet, Key: "0xabc", TokenAccountID: string(rune('a' + i)), AppID: "main"}, 1, false)
+			if err == nil {
+				s.save(claim)
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if reserved != 1 {
+		t.Errorf("%d concurrent claims passed a limit of 1", reserved)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// Config holds the settings read from config.json. Every field has a default
+// except walletAuth.domain, which must be set while NFT funding is enabled.
+// As the default collection list enables it, the server no longer starts
+// without a config file: deployments must add the domain when upgrading.
+type Config struct {
+	// AdminTokenFile holds the bearer token for the /admin endpoints. Admin
+	// endpoints are disabled when the file does not exist.
+	AdminTokenFile        string                      `json:"adminTokenFile"`
+	EmailCanonicalization EmailCanonicalizationConfig `json:"emailCanonicalization"`
+	Entitlements          EntitlementsConfig          `json:"entitlements"`
+	Indiegogo             IndiegogoConfig             `json:"indiegogo"`
+	EasyShip              EasyShipConfig              `json:"easyship"`
+	OTP                   OTPConfig                   `json:"otp"`
+	SMS                   SMSConfig                   `json:"sms"`
+	Email                 EmailConfig                 `json:"email"`
+	EmailQueue            EmailQueueConfig            `json:"emailQueue"`
+	ConfirmationEmail     ConfirmationEmailConfig     `json:"confirmationEmail"`
+	Notifications         NotificationsConfig         `json:"notifications"`
+	NFT                   NFTConfig                   `json:"nft"`
+	WalletAuth            WalletAuthConfig            `json:"walletAuth"`
+	Programs              []ProgramConfig             `json:"programs"`
+	RateLimit             RateLimitConfig             `json:"rateLimit"`
+}
+
+// ConfirmationEmailConfig controls the email sent after an account is funded.
+// DisabledApps opts apps out, e.g. those registering synthetic identities.
+type ConfirmationEmailConfig struct {
+	Enabled      bool     `json:"enabled"`
+	DisabledApps []string `json:"disabledApps"`
+}
+
+// EmailCanonicalizationConfig controls how email addresses are reduced to a
+// canonical mailbox before they are compared or used as a key.
+type EmailCanonicalizationConfig struct {
+	// ProviderRules enables the provider specific rules below. Case folding
+	// and IDNA conversion of the domain are always applied.
+	ProviderRules bool                `json:"providerRules"`
+	Providers     []EmailProviderRule `json:"providers"`
+}
+
+// EmailProviderRule describes the local-part rules of a mail provider.
+type EmailProviderRule struct {
+	Domains         []string `json:"domains"`
+	CanonicalDomain string   `json:"canonicalDomain"`
+	RemoveDots      bool     `json:"removeDots"`
+	StripPlusTag    bool     `json:"stripPlusTag"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		AdminTokenFile: "admin.key",
+		EmailCanonicalization: EmailCanonicalizationConfig{
+			ProviderRules: true,
+			Providers: []EmailProviderRule{
+				{
+					Domains:         []string{"gmail.com", "googlemail.com"},
+					CanonicalDomain: "gmail.com",
+					RemoveDots:      true,
+					StripPlusTag:    true,
+				},
+			},
+		},
+		Entitlements: defaultEntitlementsConfig(),
+		Indiegogo:    defaultIndiegogoConfig(),
+		EasyShip:     defaultEasyShipConfig(),
+		OTP:          defaultOTPConfig(),
+		SMS:          defaultSMSConfig(),
+		Email:        defaultEmailConfig(),
+		EmailQueue:   defaultEmailQueueConfig(),
+		ConfirmationEmail: ConfirmationEmailConfig{
+			Enabled:      true,
+			DisabledApps: []string{"land.fx.fotos", "FulaMa"},
+		},
+		Notifications: defaultNotificationsConfig(),
+		NFT:           defaultNFTConfig(),
+		WalletAuth:    defaultWalletAuthConfig(),
+		Programs:      defaultPrograms(),
+		RateLimit:     defaultRateLimitConfig(),
+	}
+}
+
+// loadConfig reads the JSON config file on top of the defaults. A missing file
+// is not an error.
+func loadConfig(filePath string) (Config, error) {
+	c := defaultConfig()
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Config file %s not found, using defaults", filePath)
+			return c, nil
+		}
+		return c, err
+	}
+	// encoding/json decodes into the elements of existing slices, so a list
+	// in the file would inherit the fields of the default entries. Lists are
+	// read into empty slices and the defaults apply only when absent.
+	defaults := c
+	c.EmailCanonicalization.Providers, c.Entitlements.Perks, c.NFT.Collections, c.Programs = nil, nil, nil, nil
+	if err := json.Unmarshal(data, &c); err != nil {
+		return defaults, fmt.Errorf("failed to parse config file %s: %v", filePath, err)
+	}
+	if c.EmailCanonicalization.Providers == nil {
+		c.EmailCanonicalization.Providers = defaults.EmailCanonicalization.Providers
+	}
+	if c.Entitlements.Perks == nil {
+		c.Entitlements.Perks = defaults.Entitlements.Perks
+	}
+	if c.NFT.Collections == nil {
+		c.NFT.Collections = defaults.NFT.Collections
+	}
+	if c.Programs == nil {
+		c.Programs = defaults.Programs
+	}
+	return c, nil
+}
+
+// Duration is a time.Duration read from a JSON string such as "10m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
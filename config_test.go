@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigListsReplaceDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+  "programs": [{"name": "helium", "fields": [{"name": "hotspot", "label": "Hotspot"}]}],
+  "nft": {"collections": [{"name": "Club", "chain": "ethereum", "contract": "0xabc"}]},
+  "entitlements": {"perks": [{"match": ["pro"], "accountsPerUnit": 2}]},
+  "emailCanonicalization": {"providers": [{"domains": ["fx.land"], "stripPlusTag": true}]}
+}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Programs) != 1 {
+		t.Fatalf("programs = %+v", c.Programs)
+	}
+	if p := c.Programs[0]; p.File != "" || p.ImportFile != "" || p.Event != "" || p.Title != "" || p.Fields[0].Unique || p.Fields[0].Type != "" {
+		t.Errorf("program inherited the Streamr defaults: %+v", p)
+	}
+	if col := c.NFT.Collections[0]; len(c.NFT.Collections) != 1 || col.OpenSeaSlug != "" {
+		t.Errorf("collections = %+v", c.NFT.Collections)
+	}
+	if perk := c.Entitlements.Perks[0]; len(c.Entitlements.Perks) != 1 || len(perk.Apps) != 0 {
+		t.Errorf("perks = %+v", c.Entitlements.Perks)
+	}
+	if rule := c.EmailCanonicalization.Providers[0]; rule.CanonicalDomain != "" || rule.RemoveDots {
+		t.Errorf("providers = %+v", c.EmailCanonicalization.Providers)
+	}
+
+	// Lists left out keep their defaults
+	if err := os.WriteFile(path, []byte(`{"adminTokenFile": "key"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err = loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Programs) != 1 || c.Programs[0].Name != "streamr" || len(c.NFT.Collections) != 1 || len(c.Entitlements.Perks) != 1 || len(c.EmailCanonicalization.Providers) != 1 {
+		t.Errorf("defaults lost: %+v", c)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestSendRegistrationConfirmation(t *testing.T) {
+	cfg = defaultConfig()
+	t.Cleanup(func() {
+		cfg = defaultConfig()
+		outbox = nil
+	})
+	tests := []struct {
+		name, email, appId string
+		enabled            bool
+		remainingSlots     int
+		sent               bool
+		slotsLine          bool
+	}{
+		{"order with slots left", "jane@example.com", "main", true, 2, true, true},
+		{"no slot count", "jane@example.com", "main", true, -1, true, false},
+		{"no slots left", "jane@example.com", "main", true, 0, true, true},
+		{"app opted out", "jane@example.com", "land.fx.fotos", true, 2, false, false},
+		{"no email", "", "main", true, 2, false, false},
+		{"disabled", "jane@example.com", "main", false, 2, false, false},
+	}
+	for _, tt := range tests {
+		q, m := newTestEmailQueue(t)
+		outbox = q
+		cfg.ConfirmationEmail.Enabled = tt.enabled
+		sendRegistrationConfirmation(tt.email, "en", tt.appId, "5Fabc", big.NewInt(1000), tt.remainingSlots)
+		q.sendDue()
+		if len(m.sent) != map[bool]int{true: 1}[tt.sent] {
+			t.Errorf("%s: %d emails sent", tt.name, len(m.sent))
+			continue
+		}
+		if !tt.sent {
+			continue
+		}
+		text := m.sent[0].Text
+		if m.sent[0].To[0].Email != tt.email || !strings.Contains(text, "Account: 5Fabc") || !strings.Contains(text, "Amount: 1000") {
+			t.Errorf("%s: sent %+v", tt.name, m.sent[0])
+		}
+		if got := strings.Contains(text, "can still fund"); got != tt.slotsLine {
+			t.Errorf("%s: remaining slots shown = %t; want %t", tt.name, got, tt.slotsLine)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Holders who keep their NFT in a cold wallet (the vault) can claim by
+// signing the challenge with a hot wallet (the delegate). The delegation is
+// proven either by a delegate registry contract read over JSON-RPC, or by a
+// delegation message signed by the vault and kept in delegations.jsonl until
+// it expires or the vault revokes it.
+
+// selectorCheckDelegateForContract is checkDelegateForContract(address to,
+// address from, address contract, bytes32 rights) of the delegate.xyz v2
+// registry, which also honours delegations of the whole vault.
+const selectorCheckDelegateForContract = "8988eea9"
+
+// DelegateRegistryV2 is the address of the delegate.xyz v2 registry, the
+// same on every chain it is deployed to.
+const DelegateRegistryV2 = "0x00000000000000447e69651d841bD8D104Bed493"
+
+const delegationsFile = "delegations.jsonl"
+
+// SignedDelegation is a delegation message signed by the vault, or with
+// Revoked set, the revocation of the delegation with the same nonce. The
+// message names the domain, chain, nonce and expiry, so a signature cannot
+// be reused elsewhere or kept forever.
+type SignedDelegation struct {
+	Time      time.Time `json:"time"`
+	Vault     string    `json:"vault"`
+	Delegate  string    `json:"delegate"`
+	Nonce     string    `json:"nonce"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	Expires   time.Time `json:"expires"`
+	Signature string    `json:"signature"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+var (
+	errDelegationNotOffered = errors.New("no delegation message was issued for the vault and delegate, or it expired")
+	errDelegationNotFound   = errors.New("no active delegation from the vault to the delegate")
+)
+
+// delegationStore keeps the active signed delegations by vault and delegate,
+// and the delegation messages handed out by /nft-challenge until they are
+// signed or the challenge nonce TTL passes.
+type delegationStore struct {
+	mu          sync.Mutex
+	delegations map[string]SignedDelegation
+	offers      map[string]SignedDelegation
+}
+
+var delegations = &delegationStore{
+	delegations: make(map[string]SignedDelegation),
+	offers:      make(map[string]SignedDelegation),
+}
+
+func delegationKey(vault, delegate string) string {
+	return strings.ToLower(vault) + "|" + strings.ToLower(delegate)
+}
+
+// load reads the delegations file. Delegations signed before messages
+// carried a nonce and expiry are not honoured any more.
+func (s *delegationStore) load() error {
+	file, err := os.Open(delegationsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var d SignedDelegation
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil || d.Nonce == "" {
+			continue
+		}
+		key := delegationKey(d.Vault, d.Delegate)
+		if d.Revoked {
+			if s.delegations[key].Nonce == d.Nonce {
+				delete(s.delegations, key)
+			}
+			continue
+		}
+		s.delegations[key] = d
+	}
+	return scanner.Err()
+}
+
+func (s *delegationStore) has(vault, delegate string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.delegations[delegationKey(vault, delegate)]
+	return ok && time.Now().Before(d.Expires)
+}
+
+// offer issues a delegation message for the vault to sign, replacing any
+// earlier unsigned one.
+func (s *delegationStore) offer(vault, delegate string) SignedDelegation {
+	now := time.Now().UTC().Truncate(time.Second)
+	d := SignedDelegation{
+		Vault:    strings.ToLower(vault),
+		Delegate: strings.ToLower(delegate),
+		Nonce:    newReference(),
+		IssuedAt: now,
+		Expires:  now.Add(time.Duration(cfg.WalletAuth.DelegationTTL)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, o := range s.offers {
+		if now.After(o.offerExpires()) {
+			delete(s.offers, key)
+		}
+	}
+	s.offers[delegationKey(vault, delegate)] = d
+	return d
+}
+
+// offerExpires is when an unsigned delegation message stops being accepted.
+func (d SignedDelegation) offerExpires() time.Time {
+	return d.IssuedAt.Add(time.Duration(cfg.WalletAuth.NonceTTL))
+}
+
+// add verifies the vault's signature of the delegation message issued for
+// the vault and delegate, and records the delegation.
+func (s *delegationStore) add(vault, delegate, signature string) error {
+	key := delegationKey(vault, delegate)
+	s.mu.Lock()
+	d, ok := s.offers[key]
+	s.mu.Unlock()
+	if !ok || time.Now().After(d.offerExpires()) {
+		return errDelegationNotOffered
+	}
+	if err := verifyVaultSignature(vault, d.message(), signature); err != nil {
+		return err
+	}
+	d.Time, d.Signature = time.Now(), signature
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.offers[key].Nonce != d.Nonce {
+		// Used by a concurrent request or replaced by a newer message
+		return errDelegationNotOffered
+	}
+	if err := appendDelegation(d); err != nil {
+		return err
+	}
+	delete(s.offers, key)
+	s.delegations[key] = d
+	return nil
+}
+
+// revoke verifies the vault's signature of the revocation message of its
+// active delegation to delegate, and records the revocation.
+func (s *delegationStore) revoke(vault, delegate, signature string) error {
+	key := delegationKey(vault, delegate)
+	s.mu.Lock()
+	d, ok := s.delegations[key]
+	s.mu.Unlock()
+	if !ok {
+		return errDelegationNotFound
+	}
+	if err := verifyVaultSignature(vault, d.revocationMessage(), signature); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.delegations[key].Nonce != d.Nonce {
+		return errDelegationNotFound
+	}
+	revocation := SignedDelegation{Time: time.Now(), Vault: d.Vault, Delegate: d.Delegate, Nonce: d.Nonce, Signature: signature, Revoked: true}
+	if err := appendDelegation(revocation); err != nil {
+		return err
+	}
+	delete(s.delegations, key)
+	return nil
+}
+
+// active returns the vault's delegation to delegate, if any.
+func (s *delegationStore) active(vault, delegate string) (SignedDelegation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.delegations[delegationKey(vault, delegate)]
+	return d, ok
+}
+
+func appendDelegation(d SignedDelegation) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(delegationsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func verifyVaultSignature(vault, message, signature string) error {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil {
+		return errInvalidSignature
+	}
+	signer, err := ecrecoverAddress(personalSignHash(message), sig)
+	if err != nil || signer != strings.ToLower(vault) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// message is the EIP-4361 style message the vault signs with personal_sign.
+func (d SignedDelegation) message() string {
+	return fmt.Sprintf("%s wants you to sign in with your Ethereum account:\n%s\n\n"+
+		"I allow the wallet %s to claim Functionyard funding with the NFTs held by my wallet until %s.\n\n"+
+		"URI: %s\nVersion: 1\nChain ID: %d\nNonce: %s\nIssued At: %s\nExpiration Time: %s\n"+
+		"Resources:\n- fula:delegate:%s",
+		cfg.WalletAuth.Domain, checksumAddress(d.Vault), checksumAddress(d.Delegate), d.Expires.Format(time.RFC3339),
+		walletAuthURI(), cfg.WalletAuth.ChainID, d.Nonce, d.IssuedAt.Format(time.RFC3339), d.Expires.Format(time.RFC3339),
+		checksumAddress(d.Delegate))
+}
+
+// revocationMessage is the message the vault signs to end the delegation.
+func (d SignedDelegation) revocationMessage() string {
+	return fmt.Sprintf("%s wants you to sign in with your Ethereum account:\n%s\n\n"+
+		"I revoke the delegation allowing the wallet %s to claim Functionyard funding with the NFTs held by my wallet.\n\n"+
+		"URI: %s\nVersion: 1\nChain ID: %d\nNonce: %s\n"+
+		"Resources:\n- fula:delegate:%s",
+		cfg.WalletAuth.Domain, checksumAddress(d.Vault), checksumAddress(d.Delegate),
+		walletAuthURI(), cfg.WalletAuth.ChainID, d.Nonce, checksumAddress(d.Delegate))
+}
+
+// nftDelegationRevokeHandler ends a signed delegation. Posted without a
+// signature it answers the revocationMessage for the vault to sign.
+func nftDelegationRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	var data struct {
+		Vault     string `json:"vault"`
+		Delegate  string `json:"delegate"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !validAddress(data.Vault) || !validAddress(data.Delegate) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "invalid_address", "message": "The wallet address is not valid."})
+		return
+	}
+	if !requireRateLimit(w, ipKey(r)) {
+		return
+	}
+	d, ok := delegations.active(data.Vault, data.Delegate)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "error", "code": "delegation_not_found", "message": "The vault has not signed a delegation to this wallet."})
+		return
+	}
+	if data.Signature == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "success", "revocationMessage": d.revocationMessage()})
+		return
+	}
+	switch err := delegations.revoke(data.Vault, data.Delegate, data.Signature); err {
+	case nil:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "The delegation is revoked."})
+	case errDelegationNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "error", "code": "delegation_not_found", "message": "The vault has not signed a delegation to this wallet."})
+	case errInvalidSignature:
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "signature_invalid", "message": "The revocation must be signed by the vault wallet."})
+	default:
+		log.Println("Error revoking delegation:", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "The revocation could not be recorded. Please try again later.")
+	}
+}
+
+// registryDelegated asks the chain's delegate registry whether delegate may
+// act for vault on the contract.
+func registryDelegated(chain, vault, delegate, contract string) (bool, error) {
+	chainConfig := cfg.NFT.Chains[chain]
+	if chainConfig.RPCURL == "" {
+		return false, nil
+	}
+	registry := chainConfig.DelegateRegistry
+	if registry == "" {
+		registry = DelegateRegistryV2
+	}
+	to, err := abiAddress(delegate)
+	if err != nil {
+		return false, err
+	}
+	from, err := abiAddress(vault)
+	if err != nil {
+		return false, err
+	}
+	target, err := abiAddress(contract)
+	if err != nil {
+		return false, err
+	}
+	call := selectorCheckDelegateForContract + to + from + target + strings.Repeat("0", 64)
+	results, err := ethCalls(chainConfig.RPCURL, "latest", registry, []string{call})
+	if err != nil {
+		return false, err
+	}
+	if results[0].Err != nil {
+		return false, results[0].Err
+	}
+	return results[0].Value.Sign() != 0, nil
+}
+
+// delegatedOwnerships keeps the vault's ownerships the delegate may claim
+// with: all of them after a signed delegation, otherwise those whose
+// contract the registry on their chain delegates.
+func delegatedOwnerships(ownerships []NFTOwnership, vault, delegate string) []NFTOwnership {
+	if delegations.has(vault, delegate) {
+		return ownerships
+	}
+	var allowed []NFTOwnership
+	for _, o := range ownerships {
+		ok, err := registryDelegated(o.Collection.Chain, vault, delegate, o.Collection.Contract)
+		if err != nil {
+			log.Printf("Error checking the delegate registry on %s for %s: %v", o.Collection.Chain, vault, err)
+			continue
+		}
+		if ok {
+			allowed = append(allowed, o)
+		}
+	}
+	return allowed
+}
+
+// holderOwnerships checks the NFT ownership behind a request signed by
+// address. When vault is set, the vault's NFTs are checked and only those the
+// address is a delegate for are kept; a delegation signature from the vault
+// is verified and recorded first. It returns false after writing an error
+// response.
+func holderOwnerships(w http.ResponseWriter, address, vault, delegationSignature, appId string) ([]NFTOwnership, bool) {
+	owner := address
+	if vault != "" {
+		if !validAddress(vault) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "invalid_address", "message": "The vault address is not valid."})
+			return nil, false
+		}
+		if delegationSignature != "" {
+			if err := delegations.add(vault, address, delegationSignature); err == errDelegationNotOffered {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "delegation_invalid", "message": "The delegation message has expired. Please request a new challenge and sign it again."})
+				return nil, false
+			} else if err != nil {
+				log.Printf("Rejected delegation from %s to %s: %v", vault, address, err)
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "delegation_invalid", "message": "The delegation must be signed by the vault wallet."})
+				return nil, false
+			}
+		}
+		owner = vault
+	}
+
+	ownerships, err := verifyNFTOwnership(owner, appId)
+	if err != nil {
+		writeNFTUnavailable(w)
+		return nil, false
+	}
+	if vault != "" && len(ownerships) > 0 {
+		ownerships = delegatedOwnerships(ownerships, vault, address)
+		if len(ownerships) == 0 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"status": "error", "code": "delegation_required", "message": "This wallet is not a delegate of the vault. Register it in the delegate registry or sign a delegation with the vault."})
+			return nil, false
+		}
+	}
+	return ownerships, true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+const (
+	testVault    = "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf" // private key 1
+	testDelegate = "0x2b5ad5c4795c026514f8317c7a215e218dccd6cf" // private key 2
+)
+
+func signMessage(message string, key int64) string {
+	return "0x" + hex.EncodeToString(testSign(personalSignHash(message), key, 99))
+}
+
+func newTestDelegationStore(t *testing.T) *delegationStore {
+	t.Helper()
+	inTempDir(t)
+	cfg = defaultConfig()
+	cfg.WalletAuth.Domain = "fx.land"
+	t.Cleanup(func() { cfg = defaultConfig() })
+	return &delegationStore{delegations: make(map[string]SignedDelegation), offers: make(map[string]SignedDelegation)}
+}
+
+func TestDelegationSignedByVault(t *testing.T) {
+	s := newTestDelegationStore(t)
+	if err := s.add(testVault, testDelegate, signMessage("anything", 1)); err != errDelegationNotOffered {
+		t.Errorf("delegation without a message: %v", err)
+	}
+	offer := s.offer(testVault, testDelegate)
+	if err := s.add(testVault, testDelegate, signMessage(offer.message(), 2)); err != errInvalidSignature {
+		t.Errorf("delegation signed by the delegate: %v", err)
+	}
+	signature := signMessage(offer.message(), 1)
+	if err := s.add(testVault, testDelegate, signature); err != nil {
+		t.Fatal(err)
+	}
+	if !s.has(testVault, testDelegate) {
+		t.Fatal("delegation not active")
+	}
+	// The message is used up, so the signature cannot be replayed
+	if err := s.add(testVault, testDelegate, signature); err != errDelegationNotOffered {
+		t.Errorf("replayed delegation: %v", err)
+	}
+
+	restarted := &delegationStore{delegations: make(map[string]SignedDelegation), offers: make(map[string]SignedDelegation)}
+	if err := restarted.load(); err != nil || !restarted.has(testVault, testDelegate) {
+		t.Errorf("delegation after restart: %v", err)
+	}
+}
+
+func TestDelegationExpires(t *testing.T) {
+	s := newTestDelegationStore(t)
+	cfg.WalletAuth.DelegationTTL = Duration(-time.Second)
+	offer := s.offer(testVault, testDelegate)
+	if err := s.add(testVault, testDelegate, signMessage(offer.message(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if s.has(testVault, testDelegate) {
+		t.Error("expired delegation is active")
+	}
+
+	cfg.WalletAuth.NonceTTL = Duration(-time.Second)
+	offer = s.offer(testVault, testDelegate)
+	if err := s.add(testVault, testDelegate, signMessage(offer.message(), 1)); err != errDelegationNotOffered {
+		t.Errorf("message signed too late: %v", err)
+	}
+}
+
+func TestDelegationRevoked(t *testing.T) {
+	s := newTestDelegationStore(t)
+	offer := s.offer(testVault, testDelegate)
+	if err := s.add(testVault, testDelegate, signMessage(offer.message(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := s.active(testVault, testDelegate)
+	if err := s.revoke(testVault, testDelegate, signMessage(d.revocationMessage(), 2)); err != errInvalidSignature {
+		t.Errorf("revocation signed by the delegate: %v", err)
+	}
+	if err := s.revoke(testVault, testDelegate, signMessage(d.revocationMessage(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if s.has(testVault, testDelegate) {
+		t.Error("revoked delegation is active")
+	}
+
+	restarted := &delegationStore{delegations: make(map[string]SignedDelegation), offers: make(map[string]SignedDelegation)}
+	if err := restarted.load(); err != nil || restarted.has(testVault, testDelegate) {
+		t.Errorf("revoked delegation after restart: %v", err)
+	}
+}
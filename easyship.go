@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const easyshipAPIURL = "https://api.easyship.com/2023-01/shipments"
+
+// EasyShipConfig enables verifying orders against shipments created in
+// EasyShip, for customers whose orders were never exported to the CSV.
+type EasyShipConfig struct {
+	Enabled bool `json:"enabled"`
+	// Apps limits the source to these appIds; empty means every app
+	Apps []string `json:"apps"`
+	// SKUPerks maps item SKUs to perk names for the entitlements. Without
+	// it, shipments get the default entitlement. Items whose SKU is not
+	// listed, such as merchandise, grant nothing.
+	SKUPerks map[string]string `json:"skuPerks"`
+	CacheTTL Duration          `json:"cacheTTL"`
+	PerPage  int               `json:"perPage"`
+	MaxPages int               `json:"maxPages"`
+}
+
+func defaultEasyShipConfig() EasyShipConfig {
+	return EasyShipConfig{
+		CacheTTL: Duration(10 * time.Minute),
+		PerPage:  50,
+		MaxPages: 5,
+	}
+}
+
+type OrderVerificationResponse struct {
+	Shipments []struct {
+		DestinationAddress struct {
+			ContactEmail string `json:"contact_email"`
+			ContactPhone string `json:"contact_phone"`
+		} `json:"destination_address"`
+		OrderData struct {
+			PlatformOrderNumber string `json:"platform_order_number"`
+		} `json:"order_data"`
+		Parcels []struct {
+			Items []struct {
+				SKU      string `json:"sku"`
+				Quantity int    `json:"quantity"`
+			} `json:"items"`
+		} `json:"parcels"`
+	} `json:"shipments"`
+	Meta struct {
+		Pagination struct {
+			Next *int `json:"next"`
+		} `json:"pagination"`
+	} `json:"meta"`
+}
+
+// EasyShipSource looks up shipments by platform order number. When EasyShip
+// reports that the rate limit is used up, lookups fail fast until it resets.
+type EasyShipSource struct {
+	config EasyShipConfig
+	client *http.Client
+	cache  *ttlCache[[]OrderRecord]
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+func NewEasyShipSource(config EasyShipConfig) *EasyShipSource {
+	return &EasyShipSource{
+		config: config,
+		client: &http.Client{Timeout: 20 * time.Second},
+		cache:  newTTLCache[[]OrderRecord](time.Duration(config.CacheTTL)),
+	}
+}
+
+func (s *EasyShipSource) Name() string {
+	return "easyship"
+}
+
+func (s *EasyShipSource) AllowsApp(appId string) bool {
+	return appAllowed(s.config.Apps, appId)
+}
+
+func (s *EasyShipSource) FindOrders(email, orderID string) ([]OrderRecord, error) {
+	orderID = sanitizeInput(orderID)
+	if orderID == "" {
+		return nil, nil
+	}
+	if cached, ok := s.cache.Get(orderID); ok {
+		return cached, nil
+	}
+
+	s.mu.Lock()
+	blockedUntil := s.blockedUntil
+	s.mu.Unlock()
+	if time.Now().Before(blockedUntil) {
+		return nil, fmt.Errorf("EasyShip rate limit reached, retry after %s", blockedUntil.Format(time.RFC3339))
+	}
+
+	var orders []OrderRecord
+	for page := 1; page <= s.config.MaxPages; page++ {
+		resp, err := doWithBackoff(s.client, defaultBackoff, func() (*http.Request, error) {
+			req, err := http.NewRequest("GET", easyshipAPIURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			q := req.URL.Query()
+			q.Add("platform_order_number", orderID)
+			q.Add("per_page", strconv.Itoa(s.config.PerPage))
+			q.Add("page", strconv.Itoa(page))
+			req.URL.RawQuery = q.Encode()
+			req.Header.Add("accept", "application/json")
+			req.Header.Add("authorization", authToken)
+			return req, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.trackRateLimit(resp.Header)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, statusError(resp, body)
+		}
+
+		var orderResponse OrderVerificationResponse
+		if err := json.Unmarshal(body, &orderResponse); err != nil {
+			return nil, fmt.Errorf("error decoding EasyShip response: %v", err)
+		}
+		for _, shipment := range orderResponse.Shipments {
+			// Shipments carry customs values, which are often understated,
+			// rather than what was paid
+			order := OrderRecord{
+				OrderNo:       shipment.OrderData.PlatformOrderNumber,
+				Email:         shipment.DestinationAddress.ContactEmail,
+				ShippingPhone: shipment.DestinationAddress.ContactPhone,
+				AmountUnknown: true,
+			}
+			if len(s.config.SKUPerks) > 0 {
+				for _, parcel := range shipment.Parcels {
+					for _, item := range parcel.Items {
+						quantity := item.Quantity
+						if quantity < 1 {
+							quantity = 1
+						}
+						order.LineItems = append(order.LineItems, LineItem{Perk: s.config.SKUPerks[item.SKU], Quantity: quantity})
+					}
+				}
+			}
+			orders = append(orders, order)
+		}
+		if orderResponse.Meta.Pagination.Next == nil {
+			break
+		}
+	}
+	s.cache.Set(orderID, orders)
+	return orders, nil
+}
+
+// trackRateLimit stops further lookups until the reset time once EasyShip
+// reports no remaining requests.
+func (s *EasyShipSource) trackRateLimit(h http.Header) {
+	remaining := strings.TrimSpace(h.Get("X-RateLimit-Remaining"))
+	if remaining != "0" {
+		return
+	}
+	wait, ok := retryAfter(h)
+	if !ok {
+		wait = time.Minute
+	}
+	s.mu.Lock()
+	s.blockedUntil = time.Now().Add(wait)
+	s.mu.Unlock()
+}
+
+// appAllowed reports whether appId is in apps; an empty list allows all.
+func appAllowed(apps []string, appId string) bool {
+	if len(apps) == 0 {
+		return true
+	}
+	for _, a := range apps {
+		if a == appId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// canonicalEmail reduces an email address to the form used for matching
+// orders and for keying per-email limits. The local part and domain are case
+// folded, the domain is converted to its IDNA (punycode) form and, when
+// enabled, provider rules such as Gmail's dot and plus-tag handling are
+// applied. Input that is not an address is returned sanitized and lowercased.
+func canonicalEmail(email string) string {
+	email = strings.ToLower(sanitizeInput(email))
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return email
+	}
+	local, domain := email[:at], canonicalDomain(email[at+1:])
+
+	if cfg.EmailCanonicalization.ProviderRules {
+		for _, rule := range cfg.EmailCanonicalization.Providers {
+			if !ruleMatchesDomain(rule, domain) {
+				continue
+			}
+			if rule.StripPlusTag {
+				if plus := strings.Index(local, "+"); plus > 0 {
+					local = local[:plus]
+				}
+			}
+			if rule.RemoveDots {
+				local = strings.ReplaceAll(local, ".", "")
+			}
+			if rule.CanonicalDomain != "" {
+				domain = canonicalDomain(rule.CanonicalDomain)
+			}
+			break
+		}
+	}
+	return local + "@" + domain
+}
+
+// sameMailbox reports whether two addresses deliver to the same mailbox.
+func sameMailbox(a, b string) bool {
+	return canonicalEmail(a) == canonicalEmail(b)
+}
+
+func ruleMatchesDomain(rule EmailProviderRule, domain string) bool {
+	for _, d := range rule.Domains {
+		if canonicalDomain(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalDomain lowercases a domain, unifies the IDNA label separators and
+// punycode-encodes every non-ASCII label.
+func canonicalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+	domain = strings.TrimSuffix(domain, ".")
+
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, ok := punycodeEncode(label)
+		if !ok {
+			continue
+		}
+		labels[i] = "xn--" + encoded
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters from RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycodeEncode implements the encoding procedure of RFC 3492 section 6.3.
+func punycodeEncode(label string) (string, bool) {
+	input := []rune(label)
+	var out strings.Builder
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(input) {
+		m := rune(utf8.MaxRune)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (1<<31-1-delta)/(handled+1) {
+			return "", false
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range input {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out.WriteByte(punycodeDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return out.String(), true
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeAdapt(delta, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestPunycodeEncode(t *testing.T) {
+	// Samples from RFC 3492 section 7.1 and common IDN labels
+	tests := []struct {
+		label, want string
+	}{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"日本語", "wgv71a119e"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+		{"ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	}
+	for _, tt := range tests {
+		got, ok := punycodeEncode(tt.label)
+		if !ok || got != tt.want {
+			t.Errorf("punycodeEncode(%q) = %q, %t; want %q", tt.label, got, ok, tt.want)
+		}
+	}
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	cfg = defaultConfig()
+	tests := []struct {
+		email, want string
+	}{
+		{"Jane.Doe@Example.com", "jane.doe@example.com"},
+		{"  jane@example.com ", "jane@example.com"},
+		{"Jane.Doe+testnet@gmail.com", "janedoe@gmail.com"},
+		{"j.a.n.e@googlemail.com", "jane@gmail.com"},
+		{"jane+tag@example.com", "jane+tag@example.com"},
+		{"jane@Bücher.de", "jane@xn--bcher-kva.de"},
+		{"jane@bücher。de.", "jane@xn--bcher-kva.de"},
+		{"not-an-address", "not-an-address"},
+	}
+	for _, tt := range tests {
+		if got := canonicalEmail(tt.email); got != tt.want {
+			t.Errorf("canonicalEmail(%q) = %q; want %q", tt.email, got, tt.want)
+		}
+	}
+	if !sameMailbox("JaneDoe@gmail.com", "jane.doe+x@googlemail.com") {
+		t.Error("sameMailbox should match Gmail aliases")
+	}
+
+	cfg.EmailCanonicalization.ProviderRules = false
+	defer func() { cfg = defaultConfig() }()
+	if got := canonicalEmail("Jane.Doe+x@gmail.com"); got != "jane.doe+x@gmail.com" {
+		t.Errorf("canonicalEmail without provider rules = %q", got)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmailQueueConfig controls the outbound email queue. Every email is queued
+// and sent by a background worker, with retries, deduplication of identical
+// messages and per-recipient and global rate limits.
+type EmailQueueConfig struct {
+	File        string   `json:"file"`
+	MaxAttempts int      `json:"maxAttempts"`
+	RetryDelay  Duration `json:"retryDelay"`
+	DedupWindow Duration `json:"dedupWindow"`
+	// PerRecipientLimit emails are accepted per recipient mailbox within
+	// PerRecipientWindow; further ones are dropped.
+	PerRecipientLimit  int      `json:"perRecipientLimit"`
+	PerRecipientWindow Duration `json:"perRecipientWindow"`
+	// GlobalLimit emails are sent within GlobalWindow; further ones wait.
+	GlobalLimit  int      `json:"globalLimit"`
+	GlobalWindow Duration `json:"globalWindow"`
+	Retention    Duration `json:"retention"`
+	// ExemptRecipients are not limited per recipient, nor are the recipients
+	// of email notification channels.
+	ExemptRecipients []string `json:"exemptRecipients"`
+}
+
+func defaultEmailQueueConfig() EmailQueueConfig {
+	return EmailQueueConfig{
+		File:               "emailQueue.json",
+		MaxAttempts:        5,
+		RetryDelay:         Duration(time.Minute),
+		DedupWindow:        Duration(time.Hour),
+		PerRecipientLimit:  5,
+		PerRecipientWindow: Duration(time.Hour),
+		GlobalLimit:        200,
+		GlobalWindow:       Duration(time.Hour),
+		Retention:          Duration(7 * 24 * time.Hour),
+		ExemptRecipients:   []string{"hi@fx.land"},
+	}
+}
+
+const (
+	EmailQueued = "queued"
+	EmailSent   = "sent"
+	EmailFailed = "failed"
+)
+
+var (
+	errEmailDuplicate = errors.New("an identical email was queued recently")
+	errEmailThrottled = errors.New("too many emails to this recipient")
+)
+
+// QueuedEmail is an email in the outbound queue. The bodies are cleared once
+// the email is sent or has failed, and never written to disk for sensitive
+// emails such as one-time codes.
+type QueuedEmail struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	DedupKey    string    `json:"dedupKey"`
+	Recipients  []string  `json:"recipients"`
+	Email       Email     `json:"email"`
+	Sensitive   bool      `json:"sensitive,omitempty"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	SentAt      time.Time `json:"sentAt,omitempty"`
+}
+
+// emailQueue keeps the queue in memory and persists it to a JSON file after
+// every change. Throttled emails are only counted.
+type emailQueue struct {
+	mu      sync.Mutex
+	config  EmailQueueConfig
+	mailer  Mailer
+	entries []*QueuedEmail
+	dropped int
+	wake    chan struct{}
+}
+
+var outbox *emailQueue
+
+func newEmailQueue(config EmailQueueConfig, m Mailer) (*emailQueue, error) {
+	q := &emailQueue{config: config, mailer: m, wake: make(chan struct{}, 1)}
+	data, err := os.ReadFile(config.File)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var entries []*QueuedEmail
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			switch {
+			case e.Status == "dropped":
+				// Kept by earlier versions; only counted now
+				continue
+			case e.Status != EmailQueued:
+				e.Email.HTML, e.Email.Text = "", ""
+			case e.Sensitive:
+				e.Status = EmailFailed
+				e.LastError = "not sent before a restart"
+			}
+			q.entries = append(q.entries, e)
+		}
+	}
+	return q, nil
+}
+
+// dedupKey identifies identical messages: same recipients, subject and body.
+func dedupKey(email Email, recipients []string) string {
+	h := sha256.New()
+	for _, r := range recipients {
+		h.Write([]byte(r + "\n"))
+	}
+	h.Write([]byte(email.Subject + "\n" + email.Text + "\n" + email.HTML))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (q *emailQueue) exempt(recipient string) bool {
+	for _, e := range q.config.ExemptRecipients {
+		if sameMailbox(e, recipient) {
+			return true
+		}
+	}
+	return notificationRecipient(recipient)
+}
+
+// Enqueue adds an email to the queue. It returns errEmailDuplicate when the
+// same message was queued within the dedup window and errEmailThrottled when
+// a recipient has reached its limit; throttled emails are dropped and
+// counted. Sensitive emails are not written to disk, so they are lost when
+// the server restarts before sending them.
+func (q *emailQueue) Enqueue(email Email, sensitive bool) (string, error) {
+	var recipients []string
+	for _, to := range email.To {
+		recipients = append(recipients, canonicalEmail(to.Email))
+	}
+	now := time.Now()
+	entry := &QueuedEmail{
+		ID:          newReference(),
+		Status:      EmailQueued,
+		DedupKey:    dedupKey(email, recipients),
+		Recipients:  recipients,
+		Email:       email,
+		Sensitive:   sensitive,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dedupSince := now.Add(-time.Duration(q.config.DedupWindow))
+	recipientSince := now.Add(-time.Duration(q.config.PerRecipientWindow))
+	perRecipient := make(map[string]int)
+	for _, e := range q.entries {
+		if e.DedupKey == entry.DedupKey && e.Status != EmailFailed && e.CreatedAt.After(dedupSince) {
+			return e.ID, errEmailDuplicate
+		}
+		if e.CreatedAt.After(recipientSince) {
+			for _, r := range e.Recipients {
+				perRecipient[r]++
+			}
+		}
+	}
+	for _, r := range recipients {
+		if !q.exempt(r) && perRecipient[r] >= q.config.PerRecipientLimit {
+			q.dropped++
+			log.Printf("Email %q to %v dropped, too many emails to %s (%d dropped since start)", email.Subject, recipients, r, q.dropped)
+			return "", errEmailThrottled
+		}
+	}
+	q.entries = append(q.entries, entry)
+	q.saveLocked()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return entry.ID, nil
+}
+
+// Run sends due emails until the process exits.
+func (q *emailQueue) Run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		q.sendDue()
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *emailQueue) sendDue() {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		q.pruneLocked(now)
+		sentInWindow := 0
+		globalSince := now.Add(-time.Duration(q.config.GlobalWindow))
+		var next *QueuedEmail
+		for _, e := range q.entries {
+			if e.Status == EmailSent && e.SentAt.After(globalSince) {
+				sentInWindow++
+			}
+			if next == nil && e.Status == EmailQueued && !e.NextAttempt.After(now) {
+				next = e
+			}
+		}
+		if next == nil || sentInWindow >= q.config.GlobalLimit {
+			q.mu.Unlock()
+			return
+		}
+		email := next.Email
+		q.mu.Unlock()
+
+		err := q.mailer.Send(email)
+
+		q.mu.Lock()
+		next.Attempts++
+		if err == nil {
+			next.Status = EmailSent
+			next.SentAt = time.Now()
+			next.LastError = ""
+			next.Email.HTML, next.Email.Text = "", ""
+			log.Printf("Email %s %q sent to %v", next.ID, email.Subject, next.Recipients)
+		} else {
+			next.LastError = err.Error()
+			if next.Attempts >= q.config.MaxAttempts {
+				next.Status = EmailFailed
+				next.Email.HTML, next.Email.Text = "", ""
+				log.Printf("Email %s %q to %v failed permanently: %v", next.ID, email.Subject, next.Recipients, err)
+			} else {
+				delay := time.Duration(q.config.RetryDelay) << (next.Attempts - 1)
+				next.NextAttempt = time.Now().Add(delay)
+				log.Printf("Email %s %q to %v failed, retrying in %s: %v", next.ID, email.Subject, next.Recipients, delay, err)
+			}
+		}
+		q.saveLocked()
+		q.mu.Unlock()
+	}
+}
+
+// pruneLocked forgets finished emails older than the retention period.
+func (q *emailQueue) pruneLocked(now time.Time) {
+	cutoff := now.Add(-time.Duration(q.config.Retention))
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if e.Status != EmailQueued && e.CreatedAt.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	q.entries = kept
+}
+
+func (q *emailQueue) saveLocked() {
+	entries := make([]QueuedEmail, len(q.entries))
+	for i, e := range q.entries {
+		entries[i] = *e
+		if e.Sensitive {
+			entries[i].Email.HTML, entries[i].Email.Text = "", ""
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.Println("Error marshaling email queue:", err)
+		return
+	}
+	tmp := q.config.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("Error writing email queue:", err)
+		return
+	}
+	if err := os.Rename(tmp, q.config.File); err != nil {
+		log.Println("Error writing email queue:", err)
+	}
+}
+
+// adminEmailsHandler lists queued, sent and failed emails, newest first,
+// optionally filtered by status and recipient. Bodies are left out. The
+// number of emails dropped since the start is sent in X-Emails-Dropped.
+func adminEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	to := r.URL.Query().Get("to")
+
+	type emailSummary struct {
+		ID          string    `json:"id"`
+		Status      string    `json:"status"`
+		Recipients  []string  `json:"recipients"`
+		Subject     string    `json:"subject"`
+		Attempts    int       `json:"attempts"`
+		LastError   string    `json:"lastError,omitempty"`
+		CreatedAt   time.Time `json:"createdAt"`
+		NextAttempt time.Time `json:"nextAttempt"`
+		SentAt      time.Time `json:"sentAt,omitempty"`
+	}
+	summaries := []emailSummary{}
+	outbox.mu.Lock()
+	for _, e := range outbox.entries {
+		if status != "" && e.Status != status {
+			continue
+		}
+		if to != "" && !strings.Contains(strings.Join(e.Recipients, ","), canonicalEmail(to)) {
+			continue
+		}
+		summaries = append(summaries, emailSummary{e.ID, e.Status, e.Recipients, e.Email.Subject, e.Attempts, e.LastError, e.CreatedAt, e.NextAttempt, e.SentAt})
+	}
+	dropped := outbox.dropped
+	outbox.mu.Unlock()
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].CreatedAt.After(summaries[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Emails-Dropped", strconv.Itoa(dropped))
+	json.NewEncoder(w).Encode(summaries)
+}
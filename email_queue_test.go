@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testMailer struct{ sent []Email }
+
+func (m *testMailer) Send(email Email) error {
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+func newTestEmailQueue(t *testing.T) (*emailQueue, *testMailer) {
+	t.Helper()
+	config := defaultEmailQueueConfig()
+	config.File = filepath.Join(t.TempDir(), "emailQueue.json")
+	config.PerRecipientLimit = 2
+	m := &testMailer{}
+	q, err := newEmailQueue(config, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, m
+}
+
+func testEmail(text string) Email {
+	return Email{To: []ToEmail{{Email: "jane@example.com"}}, Subject: "Code", Text: text}
+}
+
+func TestEmailQueueKeepsNoSensitiveBodies(t *testing.T) {
+	q, m := newTestEmailQueue(t)
+	if _, err := q.Enqueue(testEmail("Your code is 123456"), true); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(q.config.File)
+	if strings.Contains(string(data), "123456") {
+		t.Error("sensitive body written to the queue file")
+	}
+
+	if _, err := q.Enqueue(testEmail("Your order 1001"), false); err != nil {
+		t.Fatal(err)
+	}
+	q.sendDue()
+	if len(m.sent) != 2 || m.sent[0].Text != "Your code is 123456" {
+		t.Fatalf("sent %+v", m.sent)
+	}
+	data, _ = os.ReadFile(q.config.File)
+	if strings.Contains(string(data), "1001") {
+		t.Error("body kept after sending")
+	}
+
+	// A sensitive email that was not sent before a restart is given up
+	if _, err := q.Enqueue(Email{To: []ToEmail{{Email: "john@example.com"}}, Subject: "Code", Text: "654321"}, true); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := newEmailQueue(q.config, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := restarted.entries[len(restarted.entries)-1]
+	if last.Status != EmailFailed {
+		t.Errorf("unsent sensitive email reloaded as %s", last.Status)
+	}
+}
+
+func TestEmailQueueCountsDropped(t *testing.T) {
+	q, _ := newTestEmailQueue(t)
+	for i := 0; i < 5; i++ {
+		_, err := q.Enqueue(testEmail(strings.Repeat("x", i+1)), false)
+		if i >= 2 && err != errEmailThrottled {
+			t.Errorf("email %d: %v", i, err)
+		}
+	}
+	if len(q.entries) != 2 || q.dropped != 3 {
+		t.Errorf("entries = %d, dropped = %d", len(q.entries), q.dropped)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// renderedEmail is an email rendered from its templates.
+type renderedEmail struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// renderEmail renders the named email in the given language, falling back to
+// the default language. Each language is a directory holding <name>.html,
+// rendered with html/template, and <name>.txt, rendered with text/template.
+// The subject is the "subject" template defined in the .txt file.
+func renderEmail(name, lang string, data any) (renderedEmail, error) {
+	dir := filepath.Join(cfg.Email.TemplatesDir, lang)
+	if lang == "" || !fileExists(filepath.Join(dir, name+".txt")) {
+		dir = filepath.Join(cfg.Email.TemplatesDir, cfg.Email.DefaultLanguage)
+	}
+
+	textTemplate, err := texttemplate.ParseFiles(filepath.Join(dir, name+".txt"))
+	if err != nil {
+		return renderedEmail{}, err
+	}
+	var subject, text bytes.Buffer
+	if err := textTemplate.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return renderedEmail{}, err
+	}
+	if err := textTemplate.Execute(&text, data); err != nil {
+		return renderedEmail{}, err
+	}
+
+	htmlTemplate, err := htmltemplate.ParseFiles(filepath.Join(dir, name+".html"))
+	if err != nil {
+		return renderedEmail{}, err
+	}
+	var html bytes.Buffer
+	if err := htmlTemplate.Execute(&html, data); err != nil {
+		return renderedEmail{}, err
+	}
+
+	return renderedEmail{
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    html.String(),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}, nil
+}
+
+// requestLanguage picks the email language for a request: the "lang" form
+// value if given, otherwise the first Accept-Language entry with templates.
+func requestLanguage(r *http.Request) string {
+	candidates := []string{r.FormValue("lang")}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		candidates = append(candidates, strings.SplitN(part, ";", 2)[0])
+	}
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(strings.TrimSpace(candidate))
+		if candidate == "" || strings.ContainsAny(candidate, `/\.`) {
+			continue
+		}
+		if dirExists(filepath.Join(cfg.Email.TemplatesDir, candidate)) {
+			return candidate
+		}
+		// Fall back from a regional variant such as "es-mx" to "es"
+		if primary := strings.SplitN(candidate, "-", 2)[0]; primary != candidate && dirExists(filepath.Join(cfg.Email.TemplatesDir, primary)) {
+			return primary
+		}
+	}
+	return cfg.Email.DefaultLanguage
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
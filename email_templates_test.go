@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestTemplates sets up a templates directory with English and Spanish
+// order_details and an English-only otp_code.
+func writeTestTemplates(t *testing.T) {
+	t.Helper()
+	cfg = defaultConfig()
+	cfg.Email.TemplatesDir = t.TempDir()
+	t.Cleanup(func() { cfg = defaultConfig() })
+	files := map[string]string{
+		"en/order_details.txt":  `{{define "subject"}}Order {{.}}{{end}}Your order {{.}}`,
+		"en/order_details.html": `<p>Your order {{.}}</p>`,
+		"es/order_details.txt":  `{{define "subject"}}Pedido {{.}}{{end}}Tu pedido {{.}}`,
+		"es/order_details.html": `<p>Tu pedido {{.}}</p>`,
+		"en/otp_code.txt":       `{{define "subject"}}Code{{end}}Your code is {{.}}`,
+		"en/otp_code.html":      `<p>Your code is {{.}}</p>`,
+	}
+	for name, content := range files {
+		path := filepath.Join(cfg.Email.TemplatesDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRenderEmail(t *testing.T) {
+	writeTestTemplates(t)
+	tests := []struct {
+		name, template, lang, subject, text string
+	}{
+		{"english", "order_details", "en", "Order 1001", "Your order 1001\n"},
+		{"spanish", "order_details", "es", "Pedido 1001", "Tu pedido 1001\n"},
+		{"no language", "order_details", "", "Order 1001", "Your order 1001\n"},
+		{"language without templates", "order_details", "fr", "Order 1001", "Your order 1001\n"},
+		{"template missing in the language", "otp_code", "es", "Code", "Your code is 1001\n"},
+	}
+	for _, tt := range tests {
+		got, err := renderEmail(tt.template, tt.lang, "1001")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Subject != tt.subject || got.Text != tt.text {
+			t.Errorf("%s: rendered %q / %q; want %q / %q", tt.name, got.Subject, got.Text, tt.subject, tt.text)
+		}
+	}
+
+	got, err := renderEmail("order_details", "en", "<b>1001</b>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(got.HTML, "<b>") || !strings.Contains(got.Text, "<b>") {
+		t.Errorf("HTML not escaped or text escaped: %q / %q", got.HTML, got.Text)
+	}
+	if _, err := renderEmail("missing", "en", nil); err == nil {
+		t.Error("missing template rendered")
+	}
+}
+
+func TestRequestLanguage(t *testing.T) {
+	writeTestTemplates(t)
+	tests := []struct {
+		name, query, acceptLanguage, want string
+	}{
+		{"nothing given", "", "", "en"},
+		{"form value", "lang=es", "en", "es"},
+		{"accept-language", "", "fr;q=0.9, es;q=0.8", "es"},
+		{"regional variant", "", "es-MX", "es"},
+		{"unknown language", "lang=fr", "de", "en"},
+		{"path in form value", "lang=../es", "", "en"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+		r.Header.Set("Accept-Language", tt.acceptLanguage)
+		if got := requestLanguage(r); got != tt.want {
+			t.Errorf("%s: requestLanguage = %s; want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "strings"
+
+// PerkEntitlement maps the perks of an order to what they grant. A perk
+// matches when its name contains one of the Match strings, ignoring case.
+type PerkEntitlement struct {
+	Match           []string `json:"match"`
+	AccountsPerUnit int      `json:"accountsPerUnit"`
+	Apps            []string `json:"apps"`
+}
+
+// EntitlementsConfig lists the perk mappings. Default applies to orders
+// imported without perk information, one unit per order.
+type EntitlementsConfig struct {
+	Perks   []PerkEntitlement `json:"perks"`
+	Default PerkEntitlement   `json:"default"`
+}
+
+// Entitlement is what an order grants: the number of Blox accounts it can
+// fund and the apps it can be used for.
+type Entitlement struct {
+	Accounts int
+	Apps     map[string]bool
+}
+
+func (e Entitlement) AllowsApp(appId string) bool {
+	return e.Apps[appId]
+}
+
+func defaultEntitlementsConfig() EntitlementsConfig {
+	return EntitlementsConfig{
+		Perks: []PerkEntitlement{
+			{
+				Match:           []string{"blox"},
+				AccountsPerUnit: 6,
+				Apps:            []string{"main", "land.fx.blox"},
+			},
+		},
+		Default: PerkEntitlement{
+			AccountsPerUnit: 6,
+			Apps:            []string{"main", "land.fx.blox"},
+		},
+	}
+}
+
+// orderEntitlement adds up the entitlements of every line item of an order.
+// Line items whose perk is not configured, such as merchandise, grant
+// nothing.
+func orderEntitlement(order OrderRecord) Entitlement {
+	e := Entitlement{Apps: make(map[string]bool)}
+	grant := func(perk PerkEntitlement, quantity int) {
+		e.Accounts += perk.AccountsPerUnit * quantity
+		for _, app := range perk.Apps {
+			e.Apps[app] = true
+		}
+	}
+
+	if len(order.LineItems) == 0 {
+		grant(cfg.Entitlements.Default, 1)
+		return e
+	}
+	for _, item := range order.LineItems {
+		if perk, ok := findPerkEntitlement(item.Perk); ok {
+			grant(perk, item.Quantity)
+		}
+	}
+	return e
+}
+
+func findPerkEntitlement(perkName string) (PerkEntitlement, bool) {
+	perkName = strings.ToLower(perkName)
+	for _, perk := range cfg.Entitlements.Perks {
+		for _, m := range perk.Match {
+			if m != "" && strings.Contains(perkName, strings.ToLower(m)) {
+				return perk, true
+			}
+		}
+	}
+	return PerkEntitlement{}, false
+}
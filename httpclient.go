@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sensitiveQueryParams are query parameters whose values never go to the log.
+var sensitiveQueryParams = []string{"api_token", "access_token", "api_key", "apikey", "key", "token"}
+
+// redactURL returns the URL with the values of sensitive query parameters
+// replaced, for logging.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	q := redacted.Query()
+	for _, name := range sensitiveQueryParams {
+		if q.Has(name) {
+			q.Set(name, "REDACTED")
+		}
+	}
+	redacted.RawQuery = q.Encode()
+	redacted.User = nil
+	return redacted.String()
+}
+
+// redactError removes secrets from the URL embedded in errors returned by
+// http.Client.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			return &url.Error{Op: urlErr.Op, URL: redactURL(u), Err: urlErr.Err}
+		}
+	}
+	return err
+}
+
+// backoffPolicy controls how requests to third party APIs are retried when
+// they are rate limited or temporarily unavailable.
+type backoffPolicy struct {
+	MaxRetries   int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+var defaultBackoff = backoffPolicy{MaxRetries: 3, InitialDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}
+
+// doWithBackoff sends the request built by newRequest, retrying on network
+// errors, 429 and 5xx responses. Retry-After and X-RateLimit-Reset headers are
+// honored when present. The last response is returned as is, so callers must
+// still check the status code.
+func doWithBackoff(client *http.Client, policy backoffPolicy, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	delay := policy.InitialDelay
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			err = redactError(err)
+			if attempt >= policy.MaxRetries {
+				return nil, err
+			}
+			log.Printf("Request to %s failed, retrying in %s: %v", redactURL(req.URL), delay, err)
+		} else {
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return resp, nil
+			}
+			if attempt >= policy.MaxRetries {
+				return resp, nil
+			}
+			if wait, ok := retryAfter(resp.Header); ok && wait > 0 {
+				delay = wait
+			}
+			resp.Body.Close()
+			log.Printf("Request to %s returned %d, retrying in %s", redactURL(req.URL), resp.StatusCode, delay)
+		}
+
+		if delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryAfter reads how long to wait from a Retry-After header (seconds or an
+// HTTP date) or an X-RateLimit-Reset header (unix time or seconds).
+func retryAfter(h http.Header) (time.Duration, bool) {
+	if v := strings.TrimSpace(h.Get("Retry-After")); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t), true
+		}
+	}
+	if v := strings.TrimSpace(h.Get("X-RateLimit-Reset")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			// Large values are a unix timestamp, small ones a number of seconds
+			if n > 1e9 {
+				return time.Until(time.Unix(n, 0)), true
+			}
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// statusError describes an unexpected HTTP status from a third party API.
+func statusError(resp *http.Response, body []byte) error {
+	return fmt.Errorf("%s responded with status %d: %s", redactURL(resp.Request.URL), resp.StatusCode, strings.TrimSpace(string(body)))
+}
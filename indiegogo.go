@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const indiegogoAPIURL = "https://api.indiegogo.com/2/campaigns/%s/contributions.json"
+
+// IndiegogoConfig enables verifying orders against the live Indiegogo API,
+// for contributions made after the last CSV export.
+type IndiegogoConfig struct {
+	Enabled bool `json:"enabled"`
+	// Apps limits the source to these appIds; empty means every app
+	Apps        []string `json:"apps"`
+	CampaignIDs []string `json:"campaignIds"`
+	CacheTTL    Duration `json:"cacheTTL"`
+	// MaxPages bounds the pages fetched per lookup
+	MaxPages int `json:"maxPages"`
+}
+
+func defaultIndiegogoConfig() IndiegogoConfig {
+	return IndiegogoConfig{
+		CampaignIDs: []string{"28885449"},
+		CacheTTL:    Duration(10 * time.Minute),
+		MaxPages:    20,
+	}
+}
+
+type IndiegogoResponse struct {
+	Response []struct {
+		Email  string  `json:"email"`
+		Amount float64 `json:"amount"`
+		// Status and RefundStatus say whether the contribution was refunded
+		Status       string `json:"status"`
+		RefundStatus string `json:"refund_status"`
+		Perk         struct {
+			Label string `json:"label"`
+		} `json:"perk"`
+		Order struct {
+			ID       int64 `json:"id"`
+			Shipping struct {
+				PhoneNumber string `json:"phone_number"`
+			} `json:"shipping"`
+		} `json:"order"`
+	} `json:"response"`
+	Pagination struct {
+		Next  string `json:"next"`
+		Pages int    `json:"pages"`
+	} `json:"pagination"`
+}
+
+// IndiegogoSource looks up contributions of the configured campaigns by
+// email through the Indiegogo API.
+type IndiegogoSource struct {
+	config IndiegogoConfig
+	client *http.Client
+	cache  *ttlCache[[]OrderRecord]
+}
+
+func NewIndiegogoSource(config IndiegogoConfig) *IndiegogoSource {
+	return &IndiegogoSource{
+		config: config,
+		client: &http.Client{Timeout: 20 * time.Second},
+		cache:  newTTLCache[[]OrderRecord](time.Duration(config.CacheTTL)),
+	}
+}
+
+func (s *IndiegogoSource) Name() string {
+	return "indiegogo"
+}
+
+func (s *IndiegogoSource) AllowsApp(appId string) bool {
+	return appAllowed(s.config.Apps, appId)
+}
+
+func (s *IndiegogoSource) FindOrders(email, orderID string) ([]OrderRecord, error) {
+	email = strings.ToLower(sanitizeInput(email))
+	if cached, ok := s.cache.Get(email); ok {
+		return cached, nil
+	}
+
+	var orders []OrderRecord
+	for _, campaignID := range s.config.CampaignIDs {
+		campaignOrders, err := s.fetchContributions(campaignID, email)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, campaignOrders...)
+	}
+	s.cache.Set(email, orders)
+	return orders, nil
+}
+
+// fetchContributions walks every page of a campaign's contributions
+// filtered by email.
+func (s *IndiegogoSource) fetchContributions(campaignID, email string) ([]OrderRecord, error) {
+	var orders []OrderRecord
+	for page := 1; page <= s.config.MaxPages; page++ {
+		resp, err := doWithBackoff(s.client, defaultBackoff, func() (*http.Request, error) {
+			req, err := http.NewRequest("GET", fmt.Sprintf(indiegogoAPIURL, url.PathEscape(campaignID)), nil)
+			if err != nil {
+				return nil, err
+			}
+			q := req.URL.Query()
+			q.Add("api_token", apiToken)
+			q.Add("access_token", accessToken)
+			q.Add("email", email) // This will filter the results by the provided email
+			q.Add("page", strconv.Itoa(page))
+			req.URL.RawQuery = q.Encode()
+			req.Header.Add("accept", "application/json")
+			return req, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, statusError(resp, body)
+		}
+
+		var indiegogoResponse IndiegogoResponse
+		if err := json.Unmarshal(body, &indiegogoResponse); err != nil {
+			return nil, fmt.Errorf("error decoding Indiegogo response: %v", err)
+		}
+		for _, contribution := range indiegogoResponse.Response {
+			order := OrderRecord{
+				OrderNo:       strconv.FormatInt(contribution.Order.ID, 10),
+				Email:         contribution.Email,
+				ShippingPhone: contribution.Order.Shipping.PhoneNumber,
+				Amount:        contribution.Amount,
+				Refunded:      refundStatus(contribution.Status) || refundStatus(contribution.RefundStatus),
+			}
+			if contribution.Perk.Label != "" {
+				order.LineItems = []LineItem{{Perk: contribution.Perk.Label, Quantity: 1}}
+			}
+			orders = append(orders, order)
+		}
+
+		if len(indiegogoResponse.Response) == 0 ||
+			(indiegogoResponse.Pagination.Next == "" && page >= indiegogoResponse.Pagination.Pages) {
+			return orders, nil
+		}
+	}
+	log.Printf("Indiegogo campaign %s has more than %d pages of contributions for one email, stopped paging", campaignID, s.config.MaxPages)
+	return orders, nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailConfig selects the mail backend and holds the sender and the location
+// of the email templates. Templates are read from disk on every send, so they
+// can be edited without restarting the server.
+type EmailConfig struct {
+	// Backend is "brevo", "smtp" or "dir". The dir backend writes every
+	// message to Dir as an .eml file and is meant for development.
+	Backend         string     `json:"backend"`
+	BrevoKeyFile    string     `json:"brevoKeyFile"`
+	SMTP            SMTPConfig `json:"smtp"`
+	Dir             string     `json:"dir"`
+	Sender          Sender     `json:"sender"`
+	TemplatesDir    string     `json:"templatesDir"`
+	DefaultLanguage string     `json:"defaultLanguage"`
+}
+
+// SMTPConfig describes an SMTP relay. STARTTLS is used when the server offers
+// it; ImplicitTLS connects over TLS directly, as on port 465.
+type SMTPConfig struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Username     string `json:"username"`
+	PasswordFile string `json:"passwordFile"`
+	ImplicitTLS  bool   `json:"implicitTLS"`
+}
+
+func defaultEmailConfig() EmailConfig {
+	return EmailConfig{
+		Backend:      "brevo",
+		BrevoKeyFile: "brevo.key",
+		SMTP: SMTPConfig{
+			Port:         587,
+			PasswordFile: "smtp.key",
+		},
+		Dir: "mail",
+		Sender: Sender{
+			Name:  "Functionyard",
+			Email: "functionyard@fula.network",
+		},
+		TemplatesDir:    "templates/email",
+		DefaultLanguage: "en",
+	}
+}
+
+// Email is a rendered message ready to be sent.
+type Email struct {
+	From    Sender    `json:"from"`
+	To      []ToEmail `json:"to"`
+	Subject string    `json:"subject"`
+	HTML    string    `json:"html"`
+	Text    string    `json:"text"`
+}
+
+// Mailer sends emails through one backend.
+type Mailer interface {
+	Send(email Email) error
+}
+
+var mailer Mailer = disabledMailer{err: fmt.Errorf("mailer not configured")}
+
+func newMailer(c EmailConfig) (Mailer, error) {
+	switch c.Backend {
+	case "", "brevo":
+		apiKey, err := readAPIKey(c.BrevoKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &brevoMailer{apiKey: strings.TrimSpace(apiKey), client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "smtp":
+		if c.SMTP.Host == "" {
+			return nil, fmt.Errorf("email.smtp.host is required for the smtp backend")
+		}
+		password := ""
+		if c.SMTP.Username != "" {
+			p, err := readAPIKey(c.SMTP.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimSpace(p)
+		}
+		return &smtpMailer{config: c.SMTP, password: password}, nil
+	case "dir":
+		if err := os.MkdirAll(c.Dir, 0700); err != nil {
+			return nil, err
+		}
+		return &dirMailer{dir: c.Dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown email backend %q", c.Backend)
+	}
+}
+
+// disabledMailer is used when the configured backend could not be set up, so
+// sends fail with the setup error instead of stopping the server.
+type disabledMailer struct {
+	err error
+}
+
+func (m disabledMailer) Send(email Email) error {
+	return fmt.Errorf("email is disabled: %v", m.err)
+}
+
+// EmailRequest represents the JSON payload structure for the Brevo API request
+type EmailRequest struct {
+	Sender      Sender    `json:"sender"`
+	To          []ToEmail `json:"to"`
+	Subject     string    `json:"subject"`
+	HtmlContent string    `json:"htmlContent"`
+	TextContent string    `json:"textContent,omitempty"`
+}
+
+// Sender represents the "sender" part of the payload
+type Sender struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// ToEmail represents each recipient in the "to" array
+type ToEmail struct {
+	Email string `json:"email"`
+	Name  string `json:"name"` // This can be an empty string if the name is not used
+}
+
+const brevoAPIURL = "https://api.brevo.com/v3/smtp/email"
+
+type brevoMailer struct {
+	apiKey string
+	client *http.Client
+}
+
+func (m *brevoMailer) Send(email Email) error {
+	payloadBytes, err := json.Marshal(EmailRequest{
+		Sender:      email.From,
+		To:          email.To,
+		Subject:     email.Subject,
+		HtmlContent: email.HTML,
+		TextContent: email.Text,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling payload to JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", brevoAPIURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("api-key", m.apiKey)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request to email API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Brevo answers 201 Created for an accepted message
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API responded with non-OK status: %d, body: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+type smtpMailer struct {
+	config   SMTPConfig
+	password string
+}
+
+func (m *smtpMailer) Send(email Email) error {
+	message, err := buildMIMEMessage(email)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+	tlsConfig := &tls.Config{ServerName: m.config.Host}
+
+	var conn net.Conn
+	if m.config.ImplicitTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %v", err)
+	}
+	client, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error starting SMTP session: %v", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !m.config.ImplicitTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("error starting TLS: %v", err)
+		}
+	}
+	if m.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.config.Username, m.password, m.config.Host)); err != nil {
+			return fmt.Errorf("error authenticating to SMTP server: %v", err)
+		}
+	}
+	if err := client.Mail(email.From.Email); err != nil {
+		return err
+	}
+	for _, to := range email.To {
+		if err := client.Rcpt(to.Email); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// dirMailer writes every message to a directory instead of sending it.
+type dirMailer struct {
+	dir string
+}
+
+func (m *dirMailer) Send(email Email) error {
+	message, err := buildMIMEMessage(email)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), newReference())
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, message, 0600); err != nil {
+		return err
+	}
+	log.Printf("Email %q to %v written to %s", email.Subject, email.To, path)
+	return nil
+}
+
+func formatAddress(name, address string) string {
+	if name == "" {
+		return "<" + address + ">"
+	}
+	return mime.QEncoding.Encode("utf-8", name) + " <" + address + ">"
+}
+
+// buildMIMEMessage builds a multipart/alternative message with the plaintext
+// and HTML parts.
+func buildMIMEMessage(email Email) ([]byte, error) {
+	for _, value := range append([]string{email.Subject, email.From.Email}, recipientAddresses(email.To)...) {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid newline in email header")
+		}
+	}
+
+	var buf bytes.Buffer
+	var to []string
+	for _, recipient := range email.To {
+		to = append(to, formatAddress(recipient.Name, recipient.Email))
+	}
+	body := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", formatAddress(email.From.Name, email.From.Email))
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", body.Boundary())
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		if part.content == "" {
+			continue
+		}
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(w, strings.ReplaceAll(strings.ReplaceAll(part.content, "\r\n", "\n"), "\n", "\r\n"))
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func recipientAddresses(to []ToEmail) []string {
+	var addresses []string
+	for _, recipient := range to {
+		addresses = append(addresses, recipient.Email, recipient.Name)
+	}
+	return addresses
+}
+
+// sensitiveEmails are the templates whose bodies hold secrets, such as
+// one-time codes, and are never written to the queue file.
+var sensitiveEmails = map[string]bool{"otp_code": true}
+
+// sendTemplatedEmail renders the named templates and queues the result from
+// the configured sender. An identical email queued recently is not sent
+// again and counts as success.
+func sendTemplatedEmail(name, lang string, to []ToEmail, data any) error {
+	content, err := renderEmail(name, lang, data)
+	if err != nil {
+		return fmt.Errorf("error rendering email: %v", err)
+	}
+	id, err := outbox.Enqueue(Email{
+		From:    cfg.Email.Sender,
+		To:      to,
+		Subject: content.Subject,
+		HTML:    content.HTML,
+		Text:    content.Text,
+	}, sensitiveEmails[name])
+	if errors.Is(err, errEmailDuplicate) {
+		log.Printf("Email %q is a duplicate of queued email %s, not sending again", content.Subject, id)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// redirectTransport sends every request to the test server instead.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+var orderEmail = Email{
+	From:    Sender{Name: "Functionyard", Email: "functionyard@fula.network"},
+	To:      []ToEmail{{Email: "jane@example.com"}},
+	Subject: "Your order",
+	HTML:    "<p>Hi</p>",
+	Text:    "Hi\n",
+}
+
+func TestBrevoMailerStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusCreated, true},
+		{http.StatusOK, true},
+		{http.StatusAccepted, false},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		var got EmailRequest
+		var apiKey string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey = r.Header.Get("api-key")
+			json.NewDecoder(r.Body).Decode(&got)
+			w.WriteHeader(tt.status)
+			w.Write([]byte(`{"messageId":"<1@brevo>"}`))
+		}))
+		target, _ := url.Parse(server.URL)
+		m := &brevoMailer{apiKey: "key", client: &http.Client{Transport: redirectTransport{target}}}
+		err := m.Send(orderEmail)
+		server.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("status %d: err = %v", tt.status, err)
+		}
+		if apiKey != "key" || got.Subject != orderEmail.Subject || got.TextContent != orderEmail.Text || got.HtmlContent != orderEmail.HTML {
+			t.Errorf("status %d: sent key %q and %+v", tt.status, apiKey, got)
+		}
+	}
+}
+
+// fakeSMTPServer accepts one session on 127.0.0.1, offering AUTH PLAIN
+// without STARTTLS. It reports the AUTH credentials and the message data.
+func fakeSMTPServer(t *testing.T, password string) (int, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	session := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var log strings.Builder
+		defer func() { session <- log.String() }()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+				log.WriteString("AUTH " + string(credentials[1:]) + "\n")
+				if strings.HasSuffix(string(credentials), "\x00"+password) {
+					reply("235 OK")
+				} else {
+					reply("535 authentication failed")
+				}
+			case "MAIL", "RCPT":
+				log.WriteString(line + "\n")
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					data, err := r.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+					log.WriteString(data)
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, session
+}
+
+func TestSMTPMailerAuth(t *testing.T) {
+	tests := []struct {
+		name, username, password string
+		ok                       bool
+		auth                     string
+	}{
+		{"authenticated", "relay", "secret", true, "AUTH relay\x00secret"},
+		{"wrong password", "relay", "wrong", false, "AUTH relay\x00wrong"},
+		{"no username", "", "", true, ""},
+	}
+	for _, tt := range tests {
+		port, session := fakeSMTPServer(t, "secret")
+		m := &smtpMailer{config: SMTPConfig{Host: "127.0.0.1", Port: port, Username: tt.username}, password: tt.password}
+		err := m.Send(orderEmail)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		log := <-session
+		if tt.auth == "" && strings.Contains(log, "AUTH") || tt.auth != "" && !strings.Contains(log, tt.auth+"\n") {
+			t.Errorf("%s: session %q; want %q", tt.name, log, tt.auth)
+		}
+		if tt.ok && (!strings.Contains(log, "RCPT TO:<jane@example.com>") || !strings.Contains(log, "Subject: Your order")) {
+			t.Errorf("%s: message not delivered: %q", tt.name, log)
+		}
+		if !tt.ok && strings.Contains(log, "MAIL") {
+			t.Errorf("%s: mail sent after failed authentication", tt.name)
+		}
+	}
+}
+
+func TestBuildMIMEMessage(t *testing.T) {
+	message, err := buildMIMEMessage(orderEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: <jane@example.com>", "Content-Type: text/plain; charset=utf-8", "Content-Type: text/html; charset=utf-8", "Hi\r\n"} {
+		if !strings.Contains(string(message), want) {
+			t.Errorf("message lacks %q", want)
+		}
+	}
+	injected := orderEmail
+	injected.Subject = "Hi\r\nBcc: all@example.com"
+	if _, err := buildMIMEMessage(injected); err == nil {
+		t.Error("newline in subject accepted")
+	}
+}
@@ -32,18 +32,17 @@ type OrderRecord struct {
 	Email         string
 	ShippingPhone string
 	Amount        float64
+	// AmountUnknown is set by sources that do not report what was paid; the
+	// amount checks are skipped for their orders
+	AmountUnknown bool
+	Refunded      bool
+	LineItems     []LineItem
 }
 
-type OrderVerificationResponse struct {
-	Shipments []struct {
-		DestinationAddress struct {
-			ContactEmail string `json:"contact_email"`
-			ContactPhone string `json:"contact_phone"`
-		} `json:"destination_address"`
-		OrderData struct {
-			PlatformOrderNumber string `json:"platform_order_number"`
-		} `json:"order_data"`
-	} `json:"shipments"`
+// LineItem is a perk bought in an order.
+type LineItem struct {
+	Perk     string
+	Quantity int
 }
 
 type FundAccountRequest struct {
@@ -61,18 +60,6 @@ type FundAccountErrorResponse struct {
 	Description string `json:"description"`
 }
 
-type IndiegogoResponse struct {
-	Response []struct {
-		Email string `json:"email"`
-		Order struct {
-			ID       int64 `json:"id"`
-			Shipping struct {
-				PhoneNumber string `json:"phone_number"`
-			} `json:"shipping"`
-		} `json:"order"`
-	} `json:"response"`
-}
-
 type BalanceRequest struct {
 	Account string `json:"account"`
 }
@@ -86,41 +73,10 @@ type BalanceErrorResponse struct {
 	Description string `json:"description"`
 }
 
-// EmailRequest represents the JSON payload structure for the Brevo API request
-type EmailRequest struct {
-	Sender      Sender    `json:"sender"`
-	To          []ToEmail `json:"to"`
-	Subject     string    `json:"subject"`
-	HtmlContent string    `json:"htmlContent"`
-}
-
-// Sender represents the "sender" part of the payload
-type Sender struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-}
-
-// ToEmail represents each recipient in the "to" array
-type ToEmail struct {
-	Email string `json:"email"`
-	Name  string `json:"name"` // This can be an empty string if the name is not used
-}
-
-type OpenSeaResponse struct {
-	NFTs []struct {
-		Contract string `json:"contract"`
-	} `json:"nfts"`
-}
-
 const (
-	easyshipAPIURL  = "https://api.easyship.com/2023-01/shipments?per_page=1&platform_order_number="
-	fundAPIURL      = "https://api.node3.functionyard.fula.network/account/set_balance"
-	balanceAPIURL   = "https://api.node3.functionyard.fula.network/account/balance"
-	userDetailFile  = "userDetails.txt"
-	openSeaNFTId    = "functional-elephants-club"
-	contractAddress = "0xe44d2ce514fd50ffa3a296ee6ce01bb1ddb5b6d6"
-	chain           = "matic" // Assuming the NFT is on Polygon
-	streamrFile     = "streamr.txt"
+	fundAPIURL     = "https://api.node3.functionyard.fula.network/account/set_balance"
+	balanceAPIURL  = "https://api.node3.functionyard.fula.network/account/balance"
+	userDetailFile = "userDetails.txt"
 )
 
 var fundingAmount *big.Int
@@ -182,7 +138,86 @@ func preprocessCSVLine(line string) string {
 	return strings.ReplaceAll(line, "=\"\"\"", "\"")
 }
 
-// Reads the CSV file and returns a slice of OrderRecords
+// csvColumns holds the index of each known column of the contributions
+// export, or -1 when the column is not present.
+type csvColumns struct {
+	orderNo, email, amount, phone, status, perk, quantity int
+}
+
+// The column layout documented in the README, used when the file has no
+// recognisable header row.
+var defaultCSVColumns = csvColumns{orderNo: 0, email: 1, amount: 2, phone: 3, status: 4, perk: -1, quantity: -1}
+
+// csvAmountHeaders are the names, reduced to lowercase letters, of the columns
+// holding the amount paid. Other amounts such as "Shipping Amount" are not
+// matched.
+var csvAmountHeaders = map[string]bool{
+	"amount":             true,
+	"total":              true,
+	"totalamount":        true,
+	"ordertotal":         true,
+	"contributionamount": true,
+	"pledgeamount":       true,
+}
+
+// parseCSVHeader maps the header names of an Indiegogo or hand made export to
+// column indexes. It returns false when the record is not a header.
+func parseCSVHeader(record []string) (csvColumns, bool) {
+	cols := csvColumns{-1, -1, -1, -1, -1, -1, -1}
+	for i, name := range record {
+		name = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, name)
+		switch {
+		case cols.orderNo < 0 && (name == "orderno" || name == "ordernumber" || name == "orderid" || name == "order"):
+			cols.orderNo = i
+		case cols.email < 0 && strings.Contains(name, "email"):
+			cols.email = i
+		case cols.amount < 0 && csvAmountHeaders[name]:
+			cols.amount = i
+		case cols.phone < 0 && strings.Contains(name, "phone"):
+			cols.phone = i
+		case cols.status < 0 && strings.HasSuffix(name, "status"):
+			cols.status = i
+		case cols.perk < 0 && (strings.HasPrefix(name, "perk") || name == "item" || name == "itemname" || name == "product") && !strings.HasSuffix(name, "id"):
+			cols.perk = i
+		case cols.quantity < 0 && (strings.Contains(name, "quantity") || name == "qty"):
+			cols.quantity = i
+		}
+	}
+	if cols.orderNo < 0 || cols.email < 0 {
+		return cols, false
+	}
+	return cols, true
+}
+
+// refundStatus reports whether an order or contribution status marks it as
+// refunded, e.g. "Refunded" or "partially_refunded" but not "not_refunded".
+func refundStatus(status string) bool {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if !strings.Contains(status, "refund") {
+		return false
+	}
+	for _, negation := range []string{"not", "no ", "no_", "non"} {
+		if strings.HasPrefix(status, negation) {
+			return false
+		}
+	}
+	return true
+}
+
+func csvField(record []string, index int) string {
+	if index < 0 || index >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[index])
+}
+
+// Reads the CSV file and returns a slice of OrderRecords. Rows sharing an
+// order number are merged into one order with several line items.
 func readCSVOrders(filePath string) ([]OrderRecord, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -191,6 +226,9 @@ func readCSVOrders(filePath string) ([]OrderRecord, error) {
 	defer file.Close()
 
 	var orders []OrderRecord
+	orderIndex := make(map[string]int)
+	cols := defaultCSVColumns
+	firstLine := true
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -205,13 +243,41 @@ func readCSVOrders(filePath string) ([]OrderRecord, error) {
 			}
 			return nil, err // Handle the error as appropriate
 		}
-		cleanedAmount := strings.Replace(strings.Trim(record[2], " $"), ",", "", -1)
-		amount, _ := strconv.ParseFloat(cleanedAmount, 64) // Assuming the Amount is in the 11th column (index 10)
+		if firstLine {
+			firstLine = false
+			if header, ok := parseCSVHeader(record); ok {
+				cols = header
+				continue
+			}
+		}
+
+		cleanedAmount := strings.Replace(strings.Trim(csvField(record, cols.amount), " $"), ",", "", -1)
+		amount, _ := strconv.ParseFloat(cleanedAmount, 64)
+		refunded := refundStatus(csvField(record, cols.status))
+		var items []LineItem
+		if perk := csvField(record, cols.perk); perk != "" {
+			quantity, err := strconv.Atoi(csvField(record, cols.quantity))
+			if err != nil || quantity < 1 {
+				quantity = 1
+			}
+			items = append(items, LineItem{Perk: perk, Quantity: quantity})
+		}
+
+		orderNo := csvField(record, cols.orderNo)
+		if i, ok := orderIndex[orderNo]; ok {
+			orders[i].Amount += amount
+			orders[i].Refunded = orders[i].Refunded || refunded
+			orders[i].LineItems = append(orders[i].LineItems, items...)
+			continue
+		}
+		orderIndex[orderNo] = len(orders)
 		orders = append(orders, OrderRecord{
-			OrderNo:       strings.TrimSpace(record[0]),
-			Email:         strings.TrimSpace(record[1]),
-			ShippingPhone: strings.TrimSpace(record[3]),
+			OrderNo:       orderNo,
+			Email:         csvField(record, cols.email),
+			ShippingPhone: csvField(record, cols.phone),
 			Amount:        amount,
+			Refunded:      refunded,
+			LineItems:     items,
 		})
 	}
 	return orders, nil
@@ -243,26 +309,46 @@ func readTokensFromFile(filename string) error {
 
 func verifyNFTHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
 
 	var data struct {
-		Address string `json:"address"`
+		Address        string `json:"address"`
+		AppID          string `json:"appId"`
+		TokenAccountID string `json:"tokenAccountId"`
+		Nonce          string `json:"nonce"`
+		Signature      string `json:"signature"`
+		// Vault holds the NFTs when Address is a delegate wallet
+		Vault               string `json:"vault"`
+		DelegationSignature string `json:"delegationSignature"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !requireRateLimit(w, ipKey(r), accountKey(data.TokenAccountID)) {
+		return
+	}
+	if !requireWalletSignature(w, data.Address, data.TokenAccountID, data.Nonce, data.Signature, false) {
 		return
 	}
 
-	// Verify NFT ownership using Polygon API (you'll need to implement this)
-	hasNFT := verifyNFTOwnership(data.Address)
+	ownerships, ok := holderOwnerships(w, data.Address, data.Vault, data.DelegationSignature, data.AppID)
+	if !ok {
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{"hasNFT": hasNFT})
+	response := map[string]any{"hasNFT": len(ownerships) > 0}
+	if len(ownerships) > 0 {
+		response["collection"] = ownerships[0].Collection.Name
+		response["claimable"] = nftClaims.available(ownerships)
+	}
+	writeJSON(w, http.StatusOK, response)
 }
 
-func init() {
+// loadOrders reads the contributions file at startup.
+func loadOrders() {
 	var err error
 	cleanedOrders, err = readCSVOrders("contributions-masked.csv")
 	if err != nil {
@@ -285,23 +371,96 @@ func init() {
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		runSnapshotCommand(os.Args[2:])
+		return
+	}
 	// Parse command-line flags
+	configPath := flag.String("config", "config.json", "Path to the optional JSON config file")
 	flag.StringVar(&openSeaAPIKey, "opensea-api", "", "OpenSea API key")
 	flag.Parse()
 
+	var err error
+	cfg, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	loadOrders()
+
 	// Check if the OpenSea API key is provided
-	if openSeaAPIKey == "" {
-		log.Fatal("OpenSea API key is required. Please provide it using the --opensea-api flag.")
+	if openSeaAPIKey == "" && cfg.NFT.usesOpenSea() {
+		log.Fatal("OpenSea API key is required for the opensea NFT checker. Please provide it using the --opensea-api flag.")
 	}
 
 	log.Print("Server Started")
 	fundingAmount, _ = new(big.Int).SetString("999999999999999999999999999999", 10)
-	err := readTokensFromFile(".tokens")
+	if err := validateNFTConfig(cfg.NFT); err != nil {
+		log.Fatalf("Invalid NFT config: %v", err)
+	}
+	if err := validateWalletAuthConfig(cfg.WalletAuth, cfg.NFT); err != nil {
+		log.Fatalf("Invalid wallet auth config: %v", err)
+	}
+	if err := checkEnumerableCollections(cfg.NFT); err != nil {
+		log.Fatalf("Invalid NFT config: %v", err)
+	}
+	if err := loadHolderSnapshots(cfg.NFT); err != nil {
+		log.Fatalf("Error loading holder snapshots: %v", err)
+	}
+	nftOwnershipCache = newTTLCache[[]string](time.Duration(cfg.NFT.CacheTTL))
+	if err := nftClaims.load(); err != nil {
+		log.Fatalf("Error loading NFT claims: %v", err)
+	}
+	if err := delegations.load(); err != nil {
+		log.Fatalf("Error loading delegations: %v", err)
+	}
+	if err := validatePrograms(cfg.Programs); err != nil {
+		log.Fatalf("Invalid programs config: %v", err)
+	}
+	if err := configureRateLimits(cfg.RateLimit); err != nil {
+		log.Fatalf("Invalid rate limit config: %v", err)
+	}
+	err = readTokensFromFile(".tokens")
 	if err != nil {
 		log.Fatalf("Error reading tokens: %v", err)
 	}
-	http.HandleFunc("/streamr", streamrHandler)
+	if key, err := readAPIKey(cfg.AdminTokenFile); err == nil {
+		adminToken = strings.TrimSpace(key)
+	} else {
+		log.Println("Admin endpoints disabled:", err)
+	}
+
+	orderSources = buildOrderSources(cfg)
+	if m, err := newMailer(cfg.Email); err != nil {
+		log.Println("Error setting up email, emails will not be sent:", err)
+		mailer = disabledMailer{err: err}
+	} else {
+		mailer = m
+	}
+	outbox, err = newEmailQueue(cfg.EmailQueue, mailer)
+	if err != nil {
+		log.Fatalf("Error loading email queue: %v", err)
+	}
+	go outbox.Run()
+	if err := validateSMSConfig(cfg.SMS, cfg.OTP); err != nil {
+		log.Fatalf("Invalid SMS config: %v", err)
+	}
+	smsSender, err = newSMSSender(cfg.SMS)
+	if err != nil {
+		log.Fatalf("Error setting up SMS provider: %v", err)
+	}
+	if cfg.Notifications.Funder.Account != "" {
+		go monitorFunderBalance(cfg.Notifications.Funder)
+	}
+
+	http.HandleFunc("/admin/verifications", requireAdmin(adminVerificationsHandler))
+	http.HandleFunc("/admin/emails", requireAdmin(adminEmailsHandler))
+	if err := registerPrograms(cfg.Programs); err != nil {
+		log.Fatalf("Error setting up programs: %v", err)
+	}
+	registerAPI()
 	http.HandleFunc("/register", registerHandler)
+	http.HandleFunc("/nft-challenge", nftChallengeHandler)
+	http.HandleFunc("/nft-delegation/revoke", nftDelegationRevokeHandler)
 	http.HandleFunc("/verify-nft", verifyNFTHandler)
 	http.HandleFunc("/verify-nft-and-fund", verifyNFTAndFundHandler)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -317,84 +476,54 @@ func readAPIKey(filePath string) (string, error) {
 	return string(data), nil
 }
 
-func sendEmailDetails(toEmail string, orderID string, phoneNumber string, orderAmount float64) error {
-	apiKey, err := readAPIKey("./brevo.key")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	apiURL := "https://api.brevo.com/v3/smtp/email"
-
+func sendEmailDetails(toEmail, lang string, orderID string, phoneNumber string, orderAmount float64) error {
 	// Split the email address at "@" and use the first part as the name
-	emailParts := strings.Split(toEmail, "@")
-	namePart := emailParts[0] // The part before "@"
-
-	// Construct the HTML content
-	htmlContent := fmt.Sprintf(`
-		<html><head></head><body>
-		<p>Hello,</p>
-		<p>Thank you for your request to join our network. Here are the details of your order in the system:</p>
-		<ul>
-			<li>Order ID: %s</li>
-			<li>Phone Number: %s</li>
-			<li>Order Amount: %.2f</li>
-		</ul>
-		<p>Please double check what you entered on the join request.</p>
-		</body></html>
-	`, orderID, phoneNumber, orderAmount)
-
-	// Prepare the request payload
-	emailRequest := EmailRequest{
-		Sender: Sender{
-			Name:  "Functionyard",              // Updated sender name
-			Email: "functionyard@fula.network", // Updated sender email
-		},
-		To: []ToEmail{
-			{
-				Email: toEmail,
-				Name:  namePart,
-			},
-		},
-		Subject:     "Your Join Network Request", // Updated subject
-		HtmlContent: htmlContent,
-	}
-
-	// Marshal the payload to JSON
-	payloadBytes, err := json.Marshal(emailRequest)
-	if err != nil {
-		return fmt.Errorf("error marshaling payload to JSON: %v", err)
-	}
+	namePart := strings.Split(toEmail, "@")[0]
 
-	// Create a new HTTP POST request
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payloadBytes))
+	err := sendTemplatedEmail("order_details", lang, []ToEmail{{Email: toEmail, Name: namePart}}, struct {
+		OrderID     string
+		PhoneNumber string
+		OrderAmount float64
+	}{orderID, phoneNumber, orderAmount})
 	if err != nil {
-		return fmt.Errorf("error creating request: %v", err)
+		return err
 	}
 
-	// Set the necessary headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("accept", "application/json")
-	req.Header.Set("api-key", apiKey)
+	log.Println("Email sent successfully")
+	return nil
+}
 
-	// Make the request using the default HTTP client
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error sending request to email API: %v", err)
-	}
-	defer resp.Body.Close()
+// sendOTPEmail sends a one-time verification code
+func sendOTPEmail(toEmail, code, lang string, ttl time.Duration) error {
+	return sendTemplatedEmail("otp_code", lang, []ToEmail{{Email: toEmail, Name: strings.Split(toEmail, "@")[0]}}, struct {
+		Code    string
+		Minutes int
+	}{code, int(ttl.Minutes())})
+}
 
-	// Check the response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+// sendRegistrationConfirmation emails the details of a funded account to the
+// owner of the order, unless the app opted out. remainingSlots is left out of
+// the email when negative.
+func sendRegistrationConfirmation(toEmail, lang, appId, tokenAccountID string, amount *big.Int, remainingSlots int) {
+	if toEmail == "" || !cfg.ConfirmationEmail.Enabled {
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API responded with non-OK status: %d, body: %s", resp.StatusCode, string(body))
+	for _, disabled := range cfg.ConfirmationEmail.DisabledApps {
+		if disabled == appId {
+			return
+		}
 	}
 
-	log.Println("Email sent successfully")
-	return nil
+	err := sendTemplatedEmail("registration_confirmation", lang, []ToEmail{{Email: toEmail, Name: strings.Split(toEmail, "@")[0]}}, struct {
+		AppID          string
+		Account        string
+		Amount         string
+		Time           string
+		RemainingSlots int
+	}{appId, tokenAccountID, amount.String(), time.Now().UTC().Format(time.RFC1123), remainingSlots})
+	if err != nil {
+		log.Println("Error sending registration confirmation:", err)
+	}
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -420,12 +549,19 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !appIdValid {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid appId provided"})
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "invalid_app", "field": "appId", "message": "Invalid appId provided"})
 			return
 		}
+		if !requireRateLimit(w, ipKey(r), emailKey(email), orderKey(orderID), accountKey(tokenAccountID)) {
+			return
+		}
+
+		// The verified order and the slots it has left, for the confirmation email
+		var order *OrderRecord
+		var claim *Claim
+		remainingSlots := -1
 
-		// Skip verifyOrder and isOrderFunded checks if appId is "land.fx.fotos"
+		// Skip verifyOrder and the claim checks if appId is "land.fx.fotos"
 		if appId == "land.fx.fotos" {
 			email = fmt.Sprintf("random_%d@example.com", time.Now().Unix())
 			orderID = fmt.Sprintf("order_%d", time.Now().Unix())
@@ -435,158 +571,78 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 			orderID = fmt.Sprintf("order_%d", time.Now().Unix())
 			phoneNumber = fmt.Sprintf("555-1234-%d", time.Now().Unix()%10000)
 		} else {
-			w.Header().Set("Content-Type", "application/json")
+			result := verifyOrder(appId, email, orderID, phoneNumber)
+			if !result.Matched {
+				respondVerificationFailure(w, r, "register", email, orderID, phoneNumber, result)
+				return
+			}
+			recordVerification(r, "register", email, orderID, phoneNumber, result, false)
+			order = result.Order
+			orderID = order.OrderNo
+
+			entitlement := orderEntitlement(*result.Order)
+			if !entitlement.AllowsApp(appId) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "not_entitled", "message": "This order does not include access to this app. If you think this is a mistake please contact testnet@fx.land"})
+				return
+			}
+			// For main, the order funds at most the accounts its perks allow
+			keyLimit := -1
 			if appId == "main" {
-				// Check if the order has already funded 6 accounts
-				fundedAccounts := getFundedAccountsCount(orderID)
-				if fundedAccounts >= 6 {
-					w.WriteHeader(http.StatusBadRequest)
-					json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "This order has already funded the maximum number of accounts."})
-					return
-				}
+				keyLimit = entitlement.Accounts
 			}
-			orderFound, emailFound, foundOrderNo, foundShippingPhone, foundOrderAmount := verifyOrder(email, orderID, phoneNumber)
-			if !orderFound {
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Your order could not be found automatically or does not match what we have in our system. If your email is in the system you will shortly receive an email with registered order details. You can also contact testnet@fx.land"})
-				if emailFound {
-					err := sendEmailDetails(email, foundOrderNo, foundShippingPhone, foundOrderAmount)
-					log.Println("Email sending result")
-					log.Println(err)
-				}
+			var fundedAccounts int
+			var err error
+			claim, fundedAccounts, err = claims.reserve(Claim{KeyType: ClaimOrder, Key: orderID, TokenAccountID: tokenAccountID, AppID: appId}, keyLimit, true)
+			switch err {
+			case errClaimKeyLimit:
+				writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "account_limit_reached", "message": "This order has already funded the maximum number of accounts."})
+				return
+			case errAccountClaimed:
+				writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "account_already_registered", "message": "The account is already registered. If you think this is a mistake please contact testnet@fx.land"})
 				return
 			}
+			if appId == "main" {
+				remainingSlots = entitlement.Accounts - fundedAccounts - 1
+			}
 
-			if isOrderFunded(tokenAccountID, appId) {
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "The account is already registered. If you think this is a mistake please contact testnet@fx.land"})
+			// Apps configured for it must prove possession of the order's email or phone first
+			if !requirePossession(w, r, appId, result.Order, tokenAccountID) {
+				claims.release(claim)
 				return
 			}
 		}
+		if claim == nil {
+			// Test apps are not limited
+			claim = &Claim{KeyType: ClaimOrder, Key: orderID, TokenAccountID: tokenAccountID, AppID: appId}
+		}
 
-		success, errMsg := fundAccount(tokenAccountID)
+		success, errMsg := fundAccount(tokenAccountID, fundingAmount)
 		if !success {
 			balance, err := checkAccountBalance(tokenAccountID)
 			if err == nil && balance != "0" {
 				log.Println("Account has a positive balance, considering funding successful")
 			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": errMsg})
+				claims.release(claim)
+				go notify(EventFundingFailure, "Funding an account failed",
+					NotificationField{"App", appId},
+					NotificationField{"Account", tokenAccountID},
+					NotificationField{"Order ID", orderID},
+					NotificationField{"Error", errMsg})
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "code": "funding_failed", "message": errMsg})
 				return
 			}
 		}
 
-		w.WriteHeader(http.StatusOK)
-		saveUserDetails(orderID, tokenAccountID, appId)
-		response := map[string]string{"status": "success", "message": "Account is funded successfully"}
-		json.NewEncoder(w).Encode(response)
-	default:
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid request method"})
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
-
-func getFundedAccountsCount(orderID string) int {
-	file, err := os.Open(userDetailFile)
-	if err != nil {
-		log.Println("Error opening file:", err)
-		return 0
-	}
-	defer file.Close()
-
-	count := 0
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ", ")
-		if len(parts) >= 2 && parts[1] == orderID {
-			count++
-		}
-	}
-	return count
-}
-
-//lint:ignore U1000 will be used in future
-func verifyOrderEasyShip(email, orderID, phoneNumber string) bool {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", easyshipAPIURL+orderID, nil)
-	if err != nil {
-		log.Println("Error creating request:", err)
-		return false
-	}
-
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("authorization", authToken)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Error sending request to API:", err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	var orderResponse OrderVerificationResponse
-	if err := json.NewDecoder(resp.Body).Decode(&orderResponse); err != nil {
-		log.Println("Error decoding response:", err)
-		return false
-	}
-
-	for _, shipment := range orderResponse.Shipments {
-		if shipment.DestinationAddress.ContactEmail == email &&
-			shipment.DestinationAddress.ContactPhone == phoneNumber &&
-			shipment.OrderData.PlatformOrderNumber == orderID {
-			return true
+		claims.save(claim)
+		if order != nil {
+			sendRegistrationConfirmation(order.Email, requestLanguage(r), appId, tokenAccountID, fundingAmount, remainingSlots)
 		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Account is funded successfully"})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "error", "code": "method_not_allowed", "message": "Invalid request method"})
 	}
-	return false
 }
 
-//lint:ignore U1000 will be used in future
-func verifyOrderIgg(email, orderID, phoneNumber string) bool {
-	// Prepare the Indiegogo API request
-	client := &http.Client{}
-	indiegogoAPIURL := "https://api.indiegogo.com/2/campaigns/28885449/contributions.json"
-	req, err := http.NewRequest("GET", indiegogoAPIURL, nil)
-	if err != nil {
-		log.Println("Error creating request:", err)
-		return false
-	}
-
-	// Add the required query parameters
-	q := req.URL.Query()
-	q.Add("api_token", apiToken)
-	q.Add("access_token", accessToken)
-	q.Add("email", email) // This will filter the results by the provided email
-	req.URL.RawQuery = q.Encode()
-
-	req.Header.Add("accept", "application/json")
-
-	// Perform the API request
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Error sending request to API:", err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	// Parse the JSON response
-	var indiegogoResponse IndiegogoResponse
-	if err := json.NewDecoder(resp.Body).Decode(&indiegogoResponse); err != nil {
-		log.Println("Error decoding response:", err)
-		return false
-	}
-
-	// Check if any order matches the provided details
-	for _, contribution := range indiegogoResponse.Response {
-		if contribution.Email == email &&
-			fmt.Sprintf("%d", contribution.Order.ID) == orderID &&
-			contribution.Order.Shipping.PhoneNumber == phoneNumber {
-			return true
-		}
-	}
-
-	return false
-}
 func sanitizeInput(input string) string {
 	// Remove any non-printable characters except '@' for email
 	return strings.Map(func(r rune) rune {
@@ -597,53 +653,89 @@ func sanitizeInput(input string) string {
 	}, strings.TrimSpace(input))
 }
 
-// Verifies the order by matching the user input against the parsed CSV records
-func verifyOrder(email, orderID, phoneNumber string) (bool, bool, string, string, float64) {
+// Verifies the order by matching the user input against the parsed CSV
+// records and then, if no full match was found, against the live order
+// sources enabled for the app.
+func verifyOrder(appId, email, orderID, phoneNumber string) VerificationResult {
+	result := matchOrder(cleanedOrders, email, orderID, phoneNumber)
+	result.Source = "csv"
+	if result.Matched || result.Reason == ReasonInvalidPhone {
+		return result
+	}
+	for _, source := range orderSources {
+		if !source.AllowsApp(appId) {
+			continue
+		}
+		orders, err := source.FindOrders(email, orderID)
+		if err != nil {
+			log.Printf("Error looking up orders in %s: %v", source.Name(), err)
+			continue
+		}
+		sourceResult := matchOrder(orders, email, orderID, phoneNumber)
+		sourceResult.Source = source.Name()
+		if reasonRank[sourceResult.Reason] > reasonRank[result.Reason] {
+			result = sourceResult
+		}
+		if result.Matched {
+			break
+		}
+	}
+	return result
+}
+
+// matchOrder matches the user input against the given orders
+func matchOrder(orders []OrderRecord, email, orderID, phoneNumber string) VerificationResult {
 	sanitizedOrderID := sanitizeInput(orderID)
-	sanitizedEmail := sanitizeInput(email)
+	canonicalInputEmail := canonicalEmail(email)
 	sanitizedPhone := sanitizeInput(phoneNumber)
 	if len(sanitizedPhone) < 4 {
-		// Handle error or adjust logic as necessary
-		return false, false, "", "", 0.0
+		return VerificationResult{Reason: ReasonInvalidPhone}
 	}
 	sanitizedPhoneLast4 := sanitizedPhone[len(sanitizedPhone)-4:]
 
-	emailFound := false
-	foundOrderNo := ""
-	foundShippingPhone := ""
-	foundOrderAmount, _ := strconv.ParseFloat("0", 64)
-
-	log.Printf("verifyOrder called. sanitizedOrderID: %s, sanitizedEmail: %s, sanitizedPhoneLast4: %s", sanitizedOrderID, sanitizedEmail, sanitizedPhoneLast4)
-
-	for _, order := range cleanedOrders {
-		sanitizedOrderEmail := sanitizeInput(order.Email)
-		if strings.EqualFold(sanitizedOrderEmail, sanitizedEmail) {
-			log.Print("email found")
-			emailFound = true // Email matches.
-			foundOrderNo = order.OrderNo
-			foundShippingPhone = order.ShippingPhone
-			foundOrderAmount = order.Amount
-			if len(order.ShippingPhone) < 4 {
-				continue
-			}
-			sanitizedOrderNo := sanitizeInput(order.OrderNo)
-			sanitizedOrderPhone := sanitizeInput(order.ShippingPhone)
-			orderPhoneLast4 := order.ShippingPhone[len(sanitizedOrderPhone)-4:]
-			if strings.EqualFold(sanitizedOrderNo, sanitizedOrderID) &&
-				strings.EqualFold(orderPhoneLast4, sanitizedPhoneLast4) &&
-				order.Amount > 1 {
-				return true, true, foundOrderNo, foundShippingPhone, foundOrderAmount // Full match.
-			}
+	log.Printf("matchOrder called. sanitizedOrderID: %s, canonicalEmail: %s, sanitizedPhoneLast4: %s", sanitizedOrderID, canonicalInputEmail, sanitizedPhoneLast4)
+
+	result := VerificationResult{Reason: ReasonEmailNotFound}
+	for _, order := range orders {
+		if canonicalEmail(order.Email) != canonicalInputEmail {
+			continue
+		}
+		order := order
+		if !result.EmailMatched {
+			result.EmailMatched = true
+			result.Reason = ReasonOrderMismatch
+			result.Order = &order
+		}
+		if !strings.EqualFold(sanitizeInput(order.OrderNo), sanitizedOrderID) {
+			continue
+		}
+
+		reason := ReasonMatched
+		sanitizedOrderPhone := sanitizeInput(order.ShippingPhone)
+		if len(sanitizedOrderPhone) < 4 || !strings.EqualFold(sanitizedOrderPhone[len(sanitizedOrderPhone)-4:], sanitizedPhoneLast4) {
+			reason = ReasonPhoneMismatch
+		} else if order.Refunded {
+			reason = ReasonOrderRefunded
+		} else if order.Amount <= 1 && !order.AmountUnknown {
+			reason = ReasonAmountTooLow
+		}
+		if reasonRank[reason] > reasonRank[result.Reason] {
+			result.Reason = reason
+			result.Order = &order
+		}
+		if reason == ReasonMatched {
+			result.Matched = true
+			return result
 		}
 	}
-	return false, emailFound, foundOrderNo, foundShippingPhone, foundOrderAmount // Full match not found, return status of email match.
+	return result
 }
 
-func fundAccount(tokenAccountID string) (bool, string) {
+func fundAccount(tokenAccountID string, amount *big.Int) (bool, string) {
 	client := &http.Client{}
 	fundRequest := FundAccountRequest{
 		Seed:   seed,
-		Amount: fundingAmount,
+		Amount: amount,
 		To:     tokenAccountID,
 	}
 	requestBody, err := json.Marshal(fundRequest)
@@ -693,7 +785,7 @@ func fundAccount(tokenAccountID string) (bool, string) {
 	if successErr == nil {
 		// If there is no error, then it was a success response
 		log.Printf("Funding successful: %+v\n", fundResponse)
-		return fundResponse.Account == tokenAccountID && fundResponse.Amount.String() == fundingAmount.String(), ""
+		return fundResponse.Account == tokenAccountID && fundResponse.Amount.String() == amount.String(), ""
 	}
 
 	// Attempt to decode the response into the error structure
@@ -711,95 +803,15 @@ func fundAccount(tokenAccountID string) (bool, string) {
 	}
 }
 
-func saveUserDetails(orderID, tokenAccountID, appId string) {
-	timestamp := time.Now().Format(time.RFC3339) // Get current date/time
-	// Include appId in the record format
-	record := fmt.Sprintf("%s, %s, %s, %s\n", timestamp, orderID, tokenAccountID, appId)
-
-	file, err := os.OpenFile(userDetailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Println("Error opening file:", err)
-		return
-	}
-	defer file.Close()
-
-	if _, err := file.WriteString(record); err != nil {
-		log.Println("Error writing to file:", err)
-	}
-}
-
-func isOrderFunded(tokenAccountID, appId string) bool {
-	file, err := os.Open(userDetailFile)
-	if err != nil {
-		log.Println("Error opening file:", err)
-		return false
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Update parts length check for new format: "timestamp, orderID, tokenAccountID, appId"
-		parts := strings.Split(line, ", ")
-		if len(parts) >= 3 && parts[2] == tokenAccountID && parts[3] == appId {
-			return true
-		}
-	}
-	return false
-}
-
-func verifyNFTOwnership(address string) bool {
-	url := fmt.Sprintf("https://api.opensea.io/api/v2/chain/%s/account/%s/nfts?collection=%s", chain, address, openSeaNFTId)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		fmt.Println("Error creating request:", err)
-		return false
-	}
-
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("x-api-key", openSeaAPIKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending request:", err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response:", err)
-		return false
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("API request failed with status code: %d\n", resp.StatusCode)
-		fmt.Println("Response body:", string(body))
-		return false
-	}
-
-	var openSeaResp OpenSeaResponse
-	err = json.Unmarshal(body, &openSeaResp)
-	if err != nil {
-		fmt.Println("Error parsing JSON:", err)
-		return false
-	}
-
-	// Check if the user owns any NFTs from the specified contract
-	for _, nft := range openSeaResp.NFTs {
-		if nft.Contract == contractAddress {
-			return true
-		}
-	}
-
-	return false
+// writeNFTUnavailable answers when NFT ownership could not be checked, so
+// holders are not told they do not own the NFT.
+func writeNFTUnavailable(w http.ResponseWriter) {
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "error", "code": "nft_check_unavailable", "message": "We could not check NFT ownership right now. Please try again in a few minutes."})
 }
 
 func verifyNFTAndFundHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
 
@@ -807,186 +819,116 @@ func verifyNFTAndFundHandler(w http.ResponseWriter, r *http.Request) {
 		Address        string `json:"address"`
 		TokenAccountID string `json:"tokenAccountId"`
 		AppID          string `json:"appId"`
+		// Email optionally receives the registration confirmation
+		Email string `json:"email"`
+		// Nonce and Signature prove control of the wallet, see /nft-challenge
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
+		// Vault holds the NFTs when Address is a delegate wallet
+		Vault               string `json:"vault"`
+		DelegationSignature string `json:"delegationSignature"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
-
-	// Verify NFT ownership
-	hasNFT := verifyNFTOwnership(data.Address)
-	if !hasNFT {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "NFT verification failed. You do not own the required NFT."})
+	if !requireRateLimit(w, ipKey(r), emailKey(data.Email), accountKey(data.TokenAccountID)) {
 		return
 	}
 
-	// Check if the order (address in this case) is already funded
-	if isOrderFunded(data.Address, data.AppID) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "The order is already registered. If you think this is a mistake please contact testnet@fx.land"})
+	// The wallet owner must have signed the challenge for this account
+	if !requireWalletSignature(w, data.Address, data.TokenAccountID, data.Nonce, data.Signature, true) {
 		return
 	}
 
-	// Fund the account
-	success, errMsg := fundAccount(data.TokenAccountID)
-	if !success {
-		balance, err := checkAccountBalance(data.TokenAccountID)
-		if err == nil && balance != "0" {
-			log.Println("Account has a positive balance, considering funding successful")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": errMsg})
-			return
-		}
-	}
-
-	// Save user details
-	saveUserDetails(data.Address, data.TokenAccountID, data.AppID)
-
-	// Send success response
-	w.WriteHeader(http.StatusOK)
-	response := map[string]string{"status": "success", "message": "Account is funded successfully"}
-	json.NewEncoder(w).Encode(response)
-}
-
-func accountExists(streamrAccount string) bool {
-	file, err := os.Open(streamrFile)
-	if err != nil {
-		return false
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		if strings.Contains(scanner.Text(), streamrAccount) {
-			return true
-		}
-	}
-	return false
-}
-
-func sendStreamrEmail(email, orderID, phoneNumber, streamrAccount string) error {
-	apiKey, err := readAPIKey("./brevo.key")
-	if err != nil {
-		return err
-	}
-
-	apiURL := "https://api.brevo.com/v3/smtp/email"
-
-	htmlContent := fmt.Sprintf(`
-        <html><head></head><body>
-        <p>New Streamr node request:</p>
-        <ul>
-            <li>Email: %s</li>
-            <li>Order ID: %s</li>
-            <li>Phone Number: %s</li>
-            <li>Streamr Account: %s</li>
-        </ul>
-        </body></html>
-    `, email, orderID, phoneNumber, streamrAccount)
-
-	emailRequest := EmailRequest{
-		Sender: Sender{
-			Name:  "Functionyard",
-			Email: "functionyard@fula.network",
-		},
-		To: []ToEmail{
-			{
-				Email: "hi@fx.land",
-				Name:  "FX Land",
-			},
-		},
-		Subject:     "New Streamr node request",
-		HtmlContent: htmlContent,
-	}
-
-	payloadBytes, err := json.Marshal(emailRequest)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("accept", "application/json")
-	req.Header.Set("api-key", apiKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	// Verify NFT ownership in a collection eligible for the app
+	ownerships, ok := holderOwnerships(w, data.Address, data.Vault, data.DelegationSignature, data.AppID)
+	if !ok {
+		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("API responded with non-OK status: %d", resp.StatusCode)
+	// A delegate claims for the vault, so the vault's limits apply
+	holder, delegate := data.Address, ""
+	if data.Vault != "" {
+		holder, delegate = data.Vault, strings.ToLower(data.Address)
 	}
-
-	return nil
-}
-
-func saveStreamrAccount(streamrAccount, orderID string) error {
-	file, err := os.OpenFile(streamrFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	_, err = file.WriteString(fmt.Sprintf("%s,%s\n", streamrAccount, orderID))
-	return err
-}
-func streamrHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.ServeFile(w, r, "static/streamr.html")
+	if len(ownerships) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "nft_not_owned", "message": "NFT verification failed. You do not own the required NFT."})
 		return
 	}
 
-	email := r.FormValue("email")
-	orderID := r.FormValue("orderId")
-	phoneNumber := r.FormValue("phoneNumber")
-	streamrAccount := r.FormValue("streamrAccount")
-
-	orderFound, emailFound, foundOrderNo, foundShippingPhone, foundOrderAmount := verifyOrder(email, orderID, phoneNumber)
-	if !orderFound {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Your order could not be found automatically or does not match what we have in our system. If your email is in the system you will shortly receive an email with registered order details. You can also contact testnet@fx.land"})
-		if emailFound {
-			err := sendEmailDetails(email, foundOrderNo, foundShippingPhone, foundOrderAmount)
-			log.Println("Email sending result")
-			log.Println(err)
-		}
+	// Both the wallet and the account have limits on how often they are funded
+	claim, _, err := claims.reserve(Claim{KeyType: ClaimWallet, Key: holder, TokenAccountID: data.TokenAccountID, AppID: data.AppID}, cfg.NFT.ClaimsPerWallet, false)
+	switch err {
+	case errClaimKeyLimit:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "wallet_already_registered", "message": "This wallet is already registered. If you think this is a mistake please contact testnet@fx.land"})
+		return
+	case errAccountClaimed:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "account_already_registered", "message": "The account is already registered. If you think this is a mistake please contact testnet@fx.land"})
 		return
 	}
 
-	// Check if streamrAccount already exists in streamr.txt
-	if accountExists(streamrAccount) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "This Streamr account is already registered."})
+	// Use a token that has not been used up by earlier claims
+	collection, tokenID, ok := nftClaims.reserve(ownerships)
+	if !ok {
+		claims.release(claim)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "nft_already_claimed", "message": "The NFTs in this wallet have already been used to fund an account. If you think this is a mistake please contact testnet@fx.land"})
 		return
 	}
 
-	// Send email to hi@fx.land
-	err := sendStreamrEmail(email, orderID, phoneNumber, streamrAccount)
-	if err != nil {
-		log.Println("Error sending Streamr email:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Error processing your request. Please try again later."})
+	// Record the token used before funding, so a claim is never lost
+	tokenClaim := NFTClaimRecord{
+		Time:           time.Now(),
+		Collection:     collection.Name,
+		Chain:          collection.Chain,
+		Contract:       collection.Contract,
+		TokenID:        tokenID,
+		Address:        strings.ToLower(holder),
+		Delegate:       delegate,
+		TokenAccountID: data.TokenAccountID,
+		AppID:          data.AppID,
+	}
+	if err := nftClaims.record(tokenClaim); err != nil {
+		claims.release(claim)
+		nftClaims.release(collection, tokenID)
+		log.Println("Error recording NFT claim:", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "code": "funding_failed", "message": "The claim could not be recorded. Please try again later."})
 		return
 	}
 
-	// Save streamrAccount and orderID to streamr.txt
-	err = saveStreamrAccount(streamrAccount, orderID)
-	if err != nil {
-		log.Println("Error saving Streamr account:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Error processing your request. Please try again later."})
-		return
+	// Fund the account
+	success, errMsg := fundAccount(data.TokenAccountID, collection.Amount())
+	if !success {
+		balance, err := checkAccountBalance(data.TokenAccountID)
+		if err == nil && balance != "0" {
+			log.Println("Account has a positive balance, considering funding successful")
+		} else {
+			// Give the token back; if that cannot be recorded, it stays used
+			released := "yes"
+			claims.release(claim)
+			tokenClaim.Time, tokenClaim.Released = time.Now(), true
+			if err := nftClaims.record(tokenClaim); err != nil {
+				log.Println("Error releasing NFT claim:", err)
+				released = "no, the token stays used: " + err.Error()
+			} else {
+				nftClaims.release(collection, tokenID)
+			}
+			go notify(EventFundingFailure, "Funding an account failed",
+				NotificationField{"App", data.AppID},
+				NotificationField{"Account", data.TokenAccountID},
+				NotificationField{"Address", holder},
+				NotificationField{"Delegate", delegate},
+				NotificationField{"Collection", collection.Name},
+				NotificationField{"Token ID", tokenID},
+				NotificationField{"Token released", released},
+				NotificationField{"Error", errMsg})
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "code": "funding_failed", "message": errMsg})
+			return
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Your Streamr node request has been submitted successfully."})
+	// Save the claim
+	claims.save(claim)
+	sendRegistrationConfirmation(sanitizeInput(data.Email), requestLanguage(r), data.AppID, data.TokenAccountID, collection.Amount(), -1)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Account is funded successfully"})
 }
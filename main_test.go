@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestParseCSVHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []string
+		want   csvColumns
+		header bool
+	}{
+		{
+			name:   "indiegogo export",
+			record: []string{"Pledge ID", "Order No.", "Email", "Shipping Amount", "Amount", "Perk ID", "Perk Name", "Quantity", "Shipping Phone Number", "Status"},
+			want:   csvColumns{orderNo: 1, email: 2, amount: 4, phone: 8, status: 9, perk: 6, quantity: 7},
+			header: true,
+		},
+		{
+			name:   "readme layout",
+			record: []string{"Order No.", "Email", "Amount", "Shipping Phone Number (Masked to the last 4 digist only for security)"},
+			want:   csvColumns{orderNo: 0, email: 1, amount: 2, phone: 3, status: -1, perk: -1, quantity: -1},
+			header: true,
+		},
+		{
+			name:   "no amount column",
+			record: []string{"order_id", "E-mail", "Shipping Amount", "Tax Amount"},
+			want:   csvColumns{orderNo: 0, email: 1, amount: -1, phone: -1, status: -1, perk: -1, quantity: -1},
+			header: true,
+		},
+		{
+			name:   "data row",
+			record: []string{"1001", "jane@example.com", "299", "1234"},
+			header: false,
+		},
+	}
+	for _, tt := range tests {
+		got, header := parseCSVHeader(tt.record)
+		if header != tt.header {
+			t.Errorf("%s: header = %t; want %t", tt.name, header, tt.header)
+			continue
+		}
+		if header && got != tt.want {
+			t.Errorf("%s: columns = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRefundStatus(t *testing.T) {
+	tests := map[string]bool{
+		"":                   false,
+		"Paid":               false,
+		"Refunded":           true,
+		"partially_refunded": true,
+		"Refund requested":   true,
+		"not_refunded":       false,
+		"No refund":          false,
+		"non-refundable":     false,
+	}
+	for status, want := range tests {
+		if got := refundStatus(status); got != want {
+			t.Errorf("refundStatus(%q) = %t; want %t", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NFTConfig lists the NFT collections whose holders can fund accounts and
+// how ownership is checked. Checker is "opensea" or "rpc"; Fallback, when
+// set, is the other one and is used when the primary checker fails. The rpc
+// checker calls the JSON-RPC endpoint configured for the collection's chain.
+//
+// ClaimsPerToken is how many times one token can be used to fund an
+// account; collections can override it. ClaimsPerWallet is how many accounts
+// one wallet can fund per app.
+type NFTConfig struct {
+	Checker         string                 `json:"checker"`
+	Fallback        string                 `json:"fallback"`
+	Chains          map[string]ChainConfig `json:"chains"`
+	Collections     []NFTCollection        `json:"collections"`
+	ClaimsPerToken  int                    `json:"claimsPerToken"`
+	ClaimsPerWallet int                    `json:"claimsPerWallet"`
+	// CacheTTL is how long ownership found upstream is reused.
+	CacheTTL        Duration `json:"cacheTTL"`
+	OpenSeaMaxPages int      `json:"openSeaMaxPages"`
+}
+
+// NFTCollection is one eligible collection. Chain is the OpenSea chain
+// identifier, e.g. "matic" or "ethereum", and Standard is "erc721" (the
+// default) or "erc1155". When TokenIDs is set only tokens in those ranges
+// count; ERC-1155 collections need them for the rpc checker. Apps limits the
+// apps the collection can fund (empty means all) and FundingAmount overrides
+// the default funding amount. When Snapshot names a holder snapshot file,
+// ownership is read from it instead of being checked live.
+type NFTCollection struct {
+	Name           string         `json:"name"`
+	Chain          string         `json:"chain"`
+	Contract       string         `json:"contract"`
+	Standard       string         `json:"standard"`
+	OpenSeaSlug    string         `json:"openSeaSlug"`
+	TokenIDs       []TokenIDRange `json:"tokenIds"`
+	Apps           []string       `json:"apps"`
+	FundingAmount  string         `json:"fundingAmount"`
+	ClaimsPerToken int            `json:"claimsPerToken"`
+	Snapshot       string         `json:"snapshot"`
+}
+
+// TokenIDRange is an inclusive range of token IDs, as decimal strings.
+type TokenIDRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// maxRangeTokenIDs bounds the token IDs the rpc checker queries for one
+// collection.
+const maxRangeTokenIDs = 1000
+
+func defaultNFTConfig() NFTConfig {
+	return NFTConfig{
+		Checker:         "opensea",
+		Chains:          map[string]ChainConfig{},
+		ClaimsPerToken:  1,
+		ClaimsPerWallet: 1,
+		CacheTTL:        Duration(2 * time.Minute),
+		OpenSeaMaxPages: 20,
+		Collections: []NFTCollection{
+			{
+				Name:        "Functional Elephants Club",
+				Chain:       "matic",
+				Contract:    "0xe44d2ce514fd50ffa3a296ee6ce01bb1ddb5b6d6",
+				OpenSeaSlug: "functional-elephants-club",
+			},
+		},
+	}
+}
+
+// validateNFTConfig checks the token ID ranges and funding amounts so that
+// mistakes show up at startup rather than on a holder's claim.
+func validateNFTConfig(c NFTConfig) error {
+	usesRPC := false
+	for _, checker := range []string{c.Checker, c.Fallback} {
+		if _, ok := nftCheckers[checker]; !ok && checker != "" {
+			return fmt.Errorf("unknown NFT ownership checker %q", checker)
+		}
+		usesRPC = usesRPC || checker == "rpc"
+	}
+	if c.ClaimsPerToken < 1 || c.ClaimsPerWallet < 1 {
+		return fmt.Errorf("nft.claimsPerToken and nft.claimsPerWallet must be at least 1")
+	}
+	if c.OpenSeaMaxPages < 1 {
+		return fmt.Errorf("nft.openSeaMaxPages must be at least 1")
+	}
+	for _, collection := range c.Collections {
+		if collection.Chain == "" || collection.Contract == "" {
+			return fmt.Errorf("NFT collection %q needs a chain and a contract", collection.Name)
+		}
+		if collection.Standard != "" && collection.Standard != "erc721" && collection.Standard != "erc1155" {
+			return fmt.Errorf("NFT collection %q has an unknown standard %q", collection.Name, collection.Standard)
+		}
+		if collection.FundingAmount != "" {
+			if _, ok := new(big.Int).SetString(collection.FundingAmount, 10); !ok {
+				return fmt.Errorf("NFT collection %q has an invalid funding amount %q", collection.Name, collection.FundingAmount)
+			}
+		}
+		for _, r := range collection.TokenIDs {
+			from, okFrom := new(big.Int).SetString(r.From, 10)
+			to, okTo := new(big.Int).SetString(r.To, 10)
+			if !okFrom || !okTo || from.Cmp(to) > 0 {
+				return fmt.Errorf("NFT collection %q has an invalid token ID range %s-%s", collection.Name, r.From, r.To)
+			}
+		}
+		if usesRPC && collection.Snapshot == "" {
+			if c.Chains[collection.Chain].RPCURL == "" {
+				return fmt.Errorf("NFT collection %q: no JSON-RPC endpoint configured for chain %q", collection.Name, collection.Chain)
+			}
+			if collection.Standard == "erc1155" && len(collection.TokenIDs) == 0 {
+				return fmt.Errorf("NFT collection %q: ERC-1155 collections need token ID ranges for the rpc checker", collection.Name)
+			}
+			if len(collection.rangeTokenIDs(maxRangeTokenIDs)) > maxRangeTokenIDs {
+				return fmt.Errorf("NFT collection %q: token ID ranges cover more than %d IDs", collection.Name, maxRangeTokenIDs)
+			}
+		}
+	}
+	return nil
+}
+
+// usesOpenSea reports whether ownership of some collection is checked through
+// OpenSea, as the primary checker or as the fallback. Collections with a
+// holder snapshot are not checked upstream.
+func (c NFTConfig) usesOpenSea() bool {
+	for _, collection := range c.Collections {
+		if collection.Snapshot == "" {
+			return c.Checker == "" || c.Checker == "opensea" || c.Fallback == "opensea"
+		}
+	}
+	return false
+}
+
+// Amount is the funding amount granted to holders of the collection.
+func (c NFTCollection) Amount() *big.Int {
+	if amount, ok := new(big.Int).SetString(c.FundingAmount, 10); ok {
+		return amount
+	}
+	return fundingAmount
+}
+
+func (c NFTCollection) AllowsApp(appId string) bool {
+	return appAllowed(c.Apps, appId)
+}
+
+// eligibleTokenID reports whether a token of the collection counts, given the
+// configured token ID ranges.
+func (c NFTCollection) eligibleTokenID(tokenID string) bool {
+	if len(c.TokenIDs) == 0 {
+		return true
+	}
+	id, ok := new(big.Int).SetString(tokenID, 10)
+	if !ok {
+		return false
+	}
+	for _, r := range c.TokenIDs {
+		from, _ := new(big.Int).SetString(r.From, 10)
+		to, _ := new(big.Int).SetString(r.To, 10)
+		if id.Cmp(from) >= 0 && id.Cmp(to) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeTokenIDs lists the token IDs in the configured ranges, stopping just
+// past limit.
+func (c NFTCollection) rangeTokenIDs(limit int) []*big.Int {
+	var ids []*big.Int
+	for _, r := range c.TokenIDs {
+		from, _ := new(big.Int).SetString(r.From, 10)
+		to, _ := new(big.Int).SetString(r.To, 10)
+		for id := from; id.Cmp(to) <= 0 && len(ids) <= limit; id = new(big.Int).Add(id, big.NewInt(1)) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// NFTOwnership is an eligible collection held by an address, with the
+// eligible token IDs it holds.
+type NFTOwnership struct {
+	Collection NFTCollection
+	TokenIDs   []string
+}
+
+type OpenSeaResponse struct {
+	NFTs []struct {
+		Identifier string `json:"identifier"`
+		Contract   string `json:"contract"`
+	} `json:"nfts"`
+	Next string `json:"next"`
+}
+
+// errNFTUpstreamUnavailable means ownership could not be checked, as opposed
+// to the address not holding an eligible token.
+var errNFTUpstreamUnavailable = errors.New("NFT ownership could not be checked")
+
+// nftChecker lists the eligible token IDs of a collection held by an address.
+type nftChecker func(collection NFTCollection, address string) ([]string, error)
+
+var nftCheckers = map[string]nftChecker{
+	"opensea": openSeaTokenIDs,
+	"rpc":     rpcTokenIDs,
+}
+
+// nftOwnershipCache holds the token IDs found per collection and address, so
+// /verify-nft followed by /verify-nft-and-fund checks upstream once. Empty
+// results are not cached, so a holder who just received a token can retry.
+var nftOwnershipCache = newTTLCache[[]string](0)
+
+// verifyNFTOwnership returns the configured collections usable for the app in
+// which the address holds eligible tokens, in configuration order. When no
+// eligible token was found and a check failed, it returns
+// errNFTUpstreamUnavailable rather than reporting that nothing is owned.
+func verifyNFTOwnership(address, appId string) ([]NFTOwnership, error) {
+	var ownerships []NFTOwnership
+	failed := false
+	for _, collection := range cfg.NFT.Collections {
+		if !collection.AllowsApp(appId) {
+			continue
+		}
+		key := strings.ToLower(collection.Chain + "|" + collection.Contract + "|" + address)
+		tokenIDs, ok := nftOwnershipCache.Get(key)
+		if !ok {
+			var err error
+			tokenIDs, err = checkNFTOwnership(collection, address)
+			if err != nil {
+				log.Printf("Error checking %s ownership of %s: %v", collection.Name, address, err)
+				failed = true
+				continue
+			}
+			if len(tokenIDs) > 0 {
+				nftOwnershipCache.Set(key, tokenIDs)
+			}
+		}
+		if len(tokenIDs) > 0 {
+			ownerships = append(ownerships, NFTOwnership{Collection: collection, TokenIDs: tokenIDs})
+		}
+	}
+	if len(ownerships) == 0 && failed {
+		return nil, errNFTUpstreamUnavailable
+	}
+	return ownerships, nil
+}
+
+// checkNFTOwnership asks the primary checker and, if it fails, the fallback.
+// Collections with a holder snapshot only use the snapshot.
+func checkNFTOwnership(collection NFTCollection, address string) ([]string, error) {
+	if collection.Snapshot != "" {
+		return snapshotTokenIDs(collection, address)
+	}
+	primary := cfg.NFT.Checker
+	if primary == "" {
+		primary = "opensea"
+	}
+	tokenIDs, err := nftCheckers[primary](collection, address)
+	if err == nil || cfg.NFT.Fallback == "" || cfg.NFT.Fallback == primary {
+		return tokenIDs, err
+	}
+	log.Printf("NFT checker %s failed for %s, falling back to %s: %v", primary, collection.Name, cfg.NFT.Fallback, err)
+	return nftCheckers[cfg.NFT.Fallback](collection, address)
+}
+
+const openSeaAPIURL = "https://api.opensea.io/api/v2/chain/%s/account/%s/nfts"
+
+var openSeaClient = &http.Client{Timeout: 20 * time.Second}
+
+// openSeaTokenIDs lists the eligible token IDs of the collection held by the
+// address, according to OpenSea, following the next cursor through every
+// page.
+func openSeaTokenIDs(collection NFTCollection, address string) ([]string, error) {
+	var tokenIDs []string
+	next := ""
+	for page := 1; page <= cfg.NFT.OpenSeaMaxPages; page++ {
+		resp, err := doWithBackoff(openSeaClient, defaultBackoff, func() (*http.Request, error) {
+			req, err := http.NewRequest("GET", fmt.Sprintf(openSeaAPIURL, url.PathEscape(collection.Chain), url.PathEscape(address)), nil)
+			if err != nil {
+				return nil, err
+			}
+			q := req.URL.Query()
+			if collection.OpenSeaSlug != "" {
+				q.Add("collection", collection.OpenSeaSlug)
+			}
+			q.Add("limit", "200")
+			if next != "" {
+				q.Add("next", next)
+			}
+			req.URL.RawQuery = q.Encode()
+			req.Header.Add("accept", "application/json")
+			req.Header.Add("x-api-key", openSeaAPIKey)
+			return req, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, statusError(resp, body)
+		}
+
+		var openSeaResp OpenSeaResponse
+		if err := json.Unmarshal(body, &openSeaResp); err != nil {
+			return nil, fmt.Errorf("error decoding OpenSea response: %v", err)
+		}
+		// Keep the eligible tokens from the collection's contract
+		for _, nft := range openSeaResp.NFTs {
+			if strings.EqualFold(nft.Contract, collection.Contract) && collection.eligibleTokenID(nft.Identifier) {
+				tokenIDs = append(tokenIDs, nft.Identifier)
+			}
+		}
+		if openSeaResp.Next == "" {
+			return tokenIDs, nil
+		}
+		next = openSeaResp.Next
+	}
+	log.Printf("%s holds more than %d pages of NFTs on OpenSea, stopped paging", address, cfg.NFT.OpenSeaMaxPages)
+	return tokenIDs, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NFTClaimRecord is one funding claimed with an NFT. Claims are appended to
+// nftClaims.jsonl and counted per token so the same token cannot be passed
+// between wallets to claim again. Address is the wallet holding the NFT and
+// Delegate the hot wallet that claimed for it, if any. A claim is recorded
+// before the account is funded; when funding fails, a Released record gives
+// the claim back.
+type NFTClaimRecord struct {
+	Time           time.Time `json:"time"`
+	Collection     string    `json:"collection"`
+	Chain          string    `json:"chain"`
+	Contract       string    `json:"contract"`
+	TokenID        string    `json:"tokenId"`
+	Address        string    `json:"address"`
+	Delegate       string    `json:"delegate,omitempty"`
+	TokenAccountID string    `json:"tokenAccountId"`
+	AppID          string    `json:"appId"`
+	Released       bool      `json:"released,omitempty"`
+}
+
+const nftClaimsFile = "nftClaims.jsonl"
+
+// nftClaimStore counts the claims made with every token, including claims in
+// progress, so concurrent requests cannot use the same token twice.
+type nftClaimStore struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var nftClaims = &nftClaimStore{counts: make(map[string]int)}
+
+func nftTokenKey(chain, contract, tokenID string) string {
+	return strings.ToLower(chain + "|" + contract + "|" + tokenID)
+}
+
+// load counts the claims recorded in the claims file.
+func (s *nftClaimStore) load() error {
+	file, err := os.Open(nftClaimsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record NFTClaimRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		key := nftTokenKey(record.Chain, record.Contract, record.TokenID)
+		if record.Released {
+			s.counts[key]--
+		} else {
+			s.counts[key]++
+		}
+	}
+	return scanner.Err()
+}
+
+// claimsPerToken is how many times one token of the collection can be used.
+func (c NFTCollection) claimsPerToken() int {
+	if c.ClaimsPerToken > 0 {
+		return c.ClaimsPerToken
+	}
+	return cfg.NFT.ClaimsPerToken
+}
+
+// available reports whether any of the owned tokens can still be claimed.
+func (s *nftClaimStore) available(ownerships []NFTOwnership) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range ownerships {
+		for _, tokenID := range o.TokenIDs {
+			if s.counts[nftTokenKey(o.Collection.Chain, o.Collection.Contract, tokenID)] < o.Collection.claimsPerToken() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reserve picks the first owned token that can still be claimed and counts a
+// claim for it. The claim must then be recorded before funding, or released.
+func (s *nftClaimStore) reserve(ownerships []NFTOwnership) (NFTCollection, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range ownerships {
+		for _, tokenID := range o.TokenIDs {
+			key := nftTokenKey(o.Collection.Chain, o.Collection.Contract, tokenID)
+			if s.counts[key] < o.Collection.claimsPerToken() {
+				s.counts[key]++
+				return o.Collection, tokenID, true
+			}
+		}
+	}
+	return NFTCollection{}, "", false
+}
+
+func (s *nftClaimStore) release(collection NFTCollection, tokenID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[nftTokenKey(collection.Chain, collection.Contract, tokenID)]--
+}
+
+// record appends a reserved claim, or its release, to the claims file.
+func (s *nftClaimStore) record(record NFTClaimRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(nftClaimsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// inTempDir runs the test in an empty directory, since the stores use fixed
+// file names.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestNFTClaimReleaseSurvivesRestart(t *testing.T) {
+	inTempDir(t)
+	cfg = defaultConfig()
+	collection := NFTCollection{Name: "Genesis", Chain: "ethereum", Contract: "0xabc", ClaimsPerToken: 1}
+	ownerships := []NFTOwnership{{Collection: collection, TokenIDs: []string{"7", "9"}}}
+
+	s := &nftClaimStore{counts: make(map[string]int)}
+	for _, tokenID := range []string{"7", "9"} {
+		_, got, ok := s.reserve(ownerships)
+		if !ok || got != tokenID {
+			t.Fatalf("reserve = %s, %v; want %s", got, ok, tokenID)
+		}
+		claim := NFTClaimRecord{Collection: collection.Name, Chain: collection.Chain, Contract: collection.Contract, TokenID: got}
+		if err := s.record(claim); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Funding with token 9 failed
+	if err := s.record(NFTClaimRecord{Chain: "ethereum", Contract: "0xabc", TokenID: "9", Released: true}); err != nil {
+		t.Fatal(err)
+	}
+	s.release(collection, "9")
+
+	restarted := &nftClaimStore{counts: make(map[string]int)}
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, ok := restarted.reserve(ownerships); !ok || got != "9" {
+		t.Errorf("reserve after restart = %s, %v; want 9", got, ok)
+	}
+	if restarted.available(ownerships) {
+		t.Error("used tokens still available")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEligibleTokenID(t *testing.T) {
+	collection := NFTCollection{TokenIDs: []TokenIDRange{{From: "1", To: "100"}, {From: "5000", To: "5000"}}}
+	tests := map[string]bool{
+		"1":                                true,
+		"100":                              true,
+		"0":                                false,
+		"101":                              false,
+		"5000":                             true,
+		"4999":                             false,
+		"0x10":                             false,
+		"":                                 false,
+		"-1":                               false,
+		"99999999999999999999999999999999": false,
+	}
+	for tokenID, want := range tests {
+		if got := collection.eligibleTokenID(tokenID); got != want {
+			t.Errorf("eligibleTokenID(%q) = %t; want %t", tokenID, got, want)
+		}
+	}
+	// Without ranges every token counts
+	if !(NFTCollection{}).eligibleTokenID("99999999999999999999999999999999") {
+		t.Error("token refused without ranges")
+	}
+}
+
+func TestNFTCollectionAppsAndAmount(t *testing.T) {
+	collection := NFTCollection{Apps: []string{"main"}, FundingAmount: "5000"}
+	if !collection.AllowsApp("main") || collection.AllowsApp("land.fx.blox") {
+		t.Error("apps not limited to main")
+	}
+	if !(NFTCollection{}).AllowsApp("land.fx.blox") {
+		t.Error("collection without apps refused an app")
+	}
+	if got := collection.Amount().String(); got != "5000" {
+		t.Errorf("Amount = %s; want 5000", got)
+	}
+	if got := (NFTCollection{}).Amount(); got != fundingAmount {
+		t.Errorf("Amount without override = %v; want the default", got)
+	}
+}
+
+func TestValidateNFTConfigCollections(t *testing.T) {
+	tests := map[string]struct {
+		collection NFTCollection
+		ok         bool
+	}{
+		"valid":             {NFTCollection{Name: "A", Chain: "matic", Contract: "0xa", TokenIDs: []TokenIDRange{{From: "1", To: "10"}}, FundingAmount: "5"}, true},
+		"single token":      {NFTCollection{Name: "A", Chain: "matic", Contract: "0xa", TokenIDs: []TokenIDRange{{From: "7", To: "7"}}}, true},
+		"no chain":          {NFTCollection{Name: "A", Contract: "0xa"}, false},
+		"no contract":       {NFTCollection{Name: "A", Chain: "matic"}, false},
+		"reversed range":    {NFTCollection{Name: "A", Chain: "matic", Contract: "0xa", TokenIDs: []TokenIDRange{{From: "10", To: "1"}}}, false},
+		"hex range":         {NFTCollection{Name: "A", Chain: "matic", Contract: "0xa", TokenIDs: []TokenIDRange{{From: "0x1", To: "10"}}}, false},
+		"open range":        {NFTCollection{Name: "A", Chain: "matic", Contract: "0xa", TokenIDs: []TokenIDRange{{From: "1"}}}, false},
+		"bad funding value": {NFTCollection{Name: "A", Chain: "matic", Contract: "0xa", FundingAmount: "1e18"}, false},
+	}
+	for name, tt := range tests {
+		c := defaultNFTConfig()
+		c.Collections = []NFTCollection{tt.collection}
+		if err := validateNFTConfig(c); (err == nil) != tt.ok {
+			t.Errorf("%s: validateNFTConfig = %v", name, err)
+		}
+	}
+}
+
+func TestUsesOpenSea(t *testing.T) {
+	c := defaultNFTConfig()
+	if !c.usesOpenSea() {
+		t.Error("default config does not use OpenSea")
+	}
+	c.Checker = "rpc"
+	if c.usesOpenSea() {
+		t.Error("rpc-only config uses OpenSea")
+	}
+	c.Fallback = "opensea"
+	if !c.usesOpenSea() {
+		t.Error("OpenSea fallback not counted")
+	}
+	if (NFTConfig{Checker: "opensea"}).usesOpenSea() {
+		t.Error("config without collections uses OpenSea")
+	}
+	c = defaultNFTConfig()
+	c.Collections[0].Snapshot = "snapshot.json"
+	if c.usesOpenSea() {
+		t.Error("snapshot-only config uses OpenSea")
+	}
+}
+
+// stubNFTChecker replaces the rpc checker for the test.
+func stubNFTChecker(t *testing.T, name string, check nftChecker) {
+	t.Helper()
+	previous := nftCheckers[name]
+	nftCheckers[name] = check
+	t.Cleanup(func() { nftCheckers[name] = previous })
+}
+
+func TestNFTOwnershipCacheSkipsEmptyResults(t *testing.T) {
+	cfg = defaultConfig()
+	t.Cleanup(func() {
+		cfg = defaultConfig()
+		nftOwnershipCache = newTTLCache[[]string](0)
+	})
+	cfg.NFT.Checker = "rpc"
+	cfg.NFT.Collections = []NFTCollection{{Name: "Genesis", Chain: "ethereum", Contract: "0xabc"}}
+	nftOwnershipCache = newTTLCache[[]string](time.Minute)
+
+	var held []string
+	calls := 0
+	stubNFTChecker(t, "rpc", func(collection NFTCollection, address string) ([]string, error) {
+		calls++
+		return held, nil
+	})
+	if ownerships, err := verifyNFTOwnership("0xHolder", "main"); err != nil || len(ownerships) != 0 {
+		t.Fatalf("before buying = %v, %v", ownerships, err)
+	}
+	// The holder buys a token and retries
+	held = []string{"7"}
+	ownerships, err := verifyNFTOwnership("0xHolder", "main")
+	if err != nil || len(ownerships) != 1 {
+		t.Fatalf("after buying = %v, %v", ownerships, err)
+	}
+	verifyNFTOwnership("0xholder", "main")
+	if calls != 2 {
+		t.Errorf("checker called %d times; want 2", calls)
+	}
+}
+
+func TestOpenSeaTokenIDsPaging(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.NFT.OpenSeaMaxPages = 3
+	t.Cleanup(func() {
+		cfg = defaultConfig()
+		openSeaClient = &http.Client{Timeout: 20 * time.Second}
+	})
+	pages := map[string]string{
+		"":   `{"nfts":[{"identifier":"7","contract":"0xABC"},{"identifier":"8","contract":"0xother"}],"next":"c1"}`,
+		"c1": `{"nfts":[{"identifier":"500","contract":"0xabc"},{"identifier":"9","contract":"0xabc"}],"next":"c2"}`,
+		"c2": `{"nfts":[{"identifier":"10","contract":"0xabc"}],"next":"c3"}`,
+		"c3": `{"nfts":[{"identifier":"11","contract":"0xabc"}]}`,
+	}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query().Get("next"))
+		if r.URL.Path != "/api/v2/chain/matic/account/0xholder/nfts" || r.URL.Query().Get("collection") != "fec" || r.Header.Get("x-api-key") != openSeaAPIKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(pages[r.URL.Query().Get("next")]))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	openSeaClient = &http.Client{Transport: redirectTransport{target}}
+
+	collection := NFTCollection{Chain: "matic", Contract: "0xabc", OpenSeaSlug: "fec", TokenIDs: []TokenIDRange{{From: "1", To: "100"}}}
+	tokenIDs, err := openSeaTokenIDs(collection, "0xholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paging stops at the third page, skipping other contracts and tokens out of range
+	if got := strings.Join(tokenIDs, ","); got != "7,9,10" {
+		t.Errorf("token IDs = %s; want 7,9,10", got)
+	}
+	if got := strings.Join(requests, ","); got != ",c1,c2" {
+		t.Errorf("cursors requested = %q", got)
+	}
+
+	collection.OpenSeaSlug = "unknown"
+	if _, err := openSeaTokenIDs(collection, "0xholder"); err == nil {
+		t.Error("error status reported as no tokens")
+	}
+}
+
+func TestCheckNFTOwnershipFallback(t *testing.T) {
+	cfg = defaultConfig()
+	t.Cleanup(func() {
+		cfg = defaultConfig()
+		nftOwnershipCache = newTTLCache[[]string](0)
+	})
+	cfg.NFT.Collections = []NFTCollection{{Name: "Genesis", Chain: "ethereum", Contract: "0xabc"}}
+	openSeaDown := errors.New("opensea down")
+	var rpcErr error
+	stubNFTChecker(t, "opensea", func(collection NFTCollection, address string) ([]string, error) {
+		return nil, openSeaDown
+	})
+	stubNFTChecker(t, "rpc", func(collection NFTCollection, address string) ([]string, error) {
+		return []string{"7"}, rpcErr
+	})
+
+	tests := []struct {
+		name, fallback string
+		rpcErr         error
+		tokens         int
+		err            error
+	}{
+		{"no fallback", "", nil, 0, errNFTUpstreamUnavailable},
+		{"fallback answers", "rpc", nil, 1, nil},
+		{"fallback fails too", "rpc", errors.New("rpc down"), 0, errNFTUpstreamUnavailable},
+	}
+	for _, tt := range tests {
+		cfg.NFT.Fallback = tt.fallback
+		rpcErr = tt.rpcErr
+		ownerships, err := verifyNFTOwnership("0xholder", "main")
+		if err != tt.err || len(ownerships) != tt.tokens {
+			t.Errorf("%s: verifyNFTOwnership = %v, %v", tt.name, ownerships, err)
+		}
+	}
+}
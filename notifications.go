@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Event types that can be routed to notification channels.
+const (
+	EventStreamrRequest   = "streamr_request"
+	EventFundingFailure   = "funding_failure"
+	EventFunderLowBalance = "funder_low_balance"
+)
+
+// NotificationsConfig defines the notification channels by name and, for
+// every event type, the channels it is routed to.
+type NotificationsConfig struct {
+	Channels map[string]NotificationChannelConfig `json:"channels"`
+	Routes   map[string][]string                  `json:"routes"`
+	Funder   FunderMonitorConfig                  `json:"funder"`
+}
+
+// NotificationChannelConfig describes one channel. Type "email" mails the To
+// list, "webhook" posts the event as JSON to URL, and "chat" posts a text
+// message to an incoming webhook such as Slack ("text") or Discord
+// ("content"), as set by TextField.
+type NotificationChannelConfig struct {
+	Type      string   `json:"type"`
+	To        []string `json:"to"`
+	URL       string   `json:"url"`
+	TextField string   `json:"textField"`
+}
+
+// FunderMonitorConfig enables periodic checks of the funder account balance,
+// raising funder_low_balance when it drops below Threshold.
+type FunderMonitorConfig struct {
+	Account   string   `json:"account"`
+	Threshold string   `json:"threshold"`
+	Interval  Duration `json:"interval"`
+}
+
+func defaultNotificationsConfig() NotificationsConfig {
+	return NotificationsConfig{
+		Channels: map[string]NotificationChannelConfig{
+			"team": {Type: "email", To: []string{"hi@fx.land"}},
+		},
+		Routes: map[string][]string{
+			EventStreamrRequest: {"team"},
+		},
+		Funder: FunderMonitorConfig{Interval: Duration(10 * time.Minute)},
+	}
+}
+
+// NotificationField is a named value shown in a notification.
+type NotificationField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Notification is an event sent to the channels it is routed to.
+type Notification struct {
+	Type    string              `json:"type"`
+	Time    time.Time           `json:"time"`
+	Summary string              `json:"summary"`
+	Fields  []NotificationField `json:"fields"`
+}
+
+// Field returns the value of the named field, for use in templates.
+func (n Notification) Field(name string) string {
+	for _, f := range n.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+var notificationClient = &http.Client{Timeout: 15 * time.Second}
+
+// notificationFailures counts the notifications that failed on some channel
+// since the start.
+var notificationFailures atomic.Int64
+
+// notify sends the event to every channel routed for its type. Failures are
+// logged and counted, so they never fail the request that raised the event.
+func notify(eventType, summary string, fields ...NotificationField) {
+	n := Notification{Type: eventType, Time: time.Now().UTC(), Summary: summary, Fields: fields}
+	var errs []error
+	for _, name := range cfg.Notifications.Routes[eventType] {
+		channel, ok := cfg.Notifications.Channels[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("notification channel %q is not defined", name))
+			continue
+		}
+		if err := sendNotification(channel, n); err != nil {
+			errs = append(errs, fmt.Errorf("notification channel %q: %v", name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("Error sending %s notification (%d failed since start): %v", eventType, notificationFailures.Add(1), err)
+	}
+}
+
+// notificationRecipient reports whether the address receives an email
+// notification channel, so the email queue does not throttle it.
+func notificationRecipient(address string) bool {
+	for _, channel := range cfg.Notifications.Channels {
+		if channel.Type != "email" {
+			continue
+		}
+		for _, to := range channel.To {
+			if sameMailbox(to, address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sendNotification(channel NotificationChannelConfig, n Notification) error {
+	switch channel.Type {
+	case "email":
+		var to []ToEmail
+		for _, address := range channel.To {
+			to = append(to, ToEmail{Email: address})
+		}
+		// Events with their own template use it, the others share one
+		name := n.Type
+		if !fileExists(filepath.Join(cfg.Email.TemplatesDir, cfg.Email.DefaultLanguage, name+".txt")) {
+			name = "notification"
+		}
+		return sendTemplatedEmail(name, cfg.Email.DefaultLanguage, to, n)
+	case "webhook":
+		return postNotification(channel.URL, n)
+	case "chat":
+		field := channel.TextField
+		if field == "" {
+			field = "text"
+		}
+		text := n.Summary
+		for _, f := range n.Fields {
+			text += fmt.Sprintf("\n%s: %s", f.Name, f.Value)
+		}
+		return postNotification(channel.URL, map[string]string{field: text})
+	default:
+		return fmt.Errorf("unknown channel type %q", channel.Type)
+	}
+}
+
+func postNotification(url string, payload any) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := doWithBackoff(notificationClient, defaultBackoff, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(payloadBytes))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return statusError(resp, body)
+	}
+	return nil
+}
+
+// monitorFunderBalance checks the funder balance every interval and notifies
+// once each time it falls below the threshold.
+func monitorFunderBalance(c FunderMonitorConfig) {
+	threshold, ok := new(big.Int).SetString(c.Threshold, 10)
+	if !ok {
+		log.Printf("Invalid funder balance threshold %q, not monitoring the funder balance", c.Threshold)
+		return
+	}
+	low := false
+	for {
+		balanceStr, err := checkAccountBalance(c.Account)
+		if err != nil {
+			log.Println("Error checking funder balance:", err)
+		} else if balance, ok := new(big.Int).SetString(balanceStr, 10); ok {
+			if balance.Cmp(threshold) < 0 && !low {
+				notify(EventFunderLowBalance, "The funder account balance is low",
+					NotificationField{"Account", c.Account},
+					NotificationField{"Balance", balance.String()},
+					NotificationField{"Threshold", threshold.String()})
+			}
+			low = balance.Cmp(threshold) < 0
+		}
+		time.Sleep(time.Duration(c.Interval))
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "log"
+
+// OrderSource looks up orders that may be missing from the CSV export.
+// FindOrders returns every order it knows for the email; matching is left to
+// matchOrder so all sources are held to the same rules.
+type OrderSource interface {
+	Name() string
+	AllowsApp(appId string) bool
+	FindOrders(email, orderID string) ([]OrderRecord, error)
+}
+
+var orderSources []OrderSource
+
+func buildOrderSources(c Config) []OrderSource {
+	var sources []OrderSource
+	if c.Indiegogo.Enabled {
+		sources = append(sources, NewIndiegogoSource(c.Indiegogo))
+		log.Printf("Indiegogo order verification enabled for campaigns %v", c.Indiegogo.CampaignIDs)
+	}
+	if c.EasyShip.Enabled {
+		sources = append(sources, NewEasyShipSource(c.EasyShip))
+		log.Println("EasyShip order verification enabled")
+	}
+	return sources
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTPConfig controls the optional one-time code step that proves possession
+// of the order's email or phone before an account is funded.
+type OTPConfig struct {
+	// Apps maps an appId to the channel the code is sent through, "email"
+	// or "sms".
+	// Apps that are not listed skip the step.
+	Apps           map[string]string `json:"apps"`
+	CodeTTL        Duration          `json:"codeTTL"`
+	MaxAttempts    int               `json:"maxAttempts"`
+	ResendInterval Duration          `json:"resendInterval"`
+	MaxSends       int               `json:"maxSends"`
+}
+
+func defaultOTPConfig() OTPConfig {
+	return OTPConfig{
+		Apps:           map[string]string{},
+		CodeTTL:        Duration(10 * time.Minute),
+		MaxAttempts:    5,
+		ResendInterval: Duration(time.Minute),
+		MaxSends:       5,
+	}
+}
+
+// otpSender delivers a code to a destination of one channel.
+type otpSender func(destination, code, lang string, ttl time.Duration) error
+
+// otpChannel describes how a channel finds its destination on an order and
+// sends the code there.
+type otpChannel struct {
+	destination func(order *OrderRecord) string
+	mask        func(destination string) string
+	send        otpSender
+}
+
+var otpChannels = map[string]otpChannel{
+	"email": {
+		destination: func(order *OrderRecord) string { return order.Email },
+		mask:        maskEmail,
+		send:        sendOTPEmail,
+	},
+	"sms": {
+		destination: smsDestination,
+		mask:        maskPhone,
+		send:        sendOTPSMS,
+	},
+}
+
+type otpChallenge struct {
+	id          string
+	key         string
+	channel     string
+	destination string
+	codeHash    [32]byte
+	expires     time.Time
+	sent        *otpSent
+}
+
+// otpSent tracks the codes sent to one email or phone, whatever the order or
+// account they were requested for, so the resend throttle, send limit and
+// attempts cannot be reset by resending or by varying the request.
+type otpSent struct {
+	sends    int
+	lastSent time.Time
+	attempts int
+	expires  time.Time
+}
+
+// otpStore keeps the pending challenges in memory, keyed by id and by the
+// app, order and account they were issued for, and what was sent to each
+// destination.
+type otpStore struct {
+	mu            sync.Mutex
+	byID          map[string]*otpChallenge
+	byKey         map[string]*otpChallenge
+	byDestination map[string]*otpSent
+}
+
+var otps = &otpStore{
+	byID:          make(map[string]*otpChallenge),
+	byKey:         make(map[string]*otpChallenge),
+	byDestination: make(map[string]*otpSent),
+}
+
+var (
+	errOTPResendTooSoon    = errors.New("a code was sent recently")
+	errOTPTooManySends     = errors.New("too many codes sent")
+	errOTPNotFound         = errors.New("no pending code")
+	errOTPExpired          = errors.New("code expired")
+	errOTPTooManyAttempts  = errors.New("too many attempts")
+	errOTPInvalid          = errors.New("invalid code")
+	errOTPChannelUnhandled = errors.New("unknown verification channel")
+)
+
+func newOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// issue sends a new code for key, reusing the pending challenge. The resend
+// throttle, send limit and attempts are counted per destination. It returns
+// the challenge and, when throttled, how long to wait; the challenge is nil
+// when another request is throttled for the destination.
+func (s *otpStore) issue(key, channelName, destination, lang string) (*otpChallenge, time.Duration, error) {
+	channel, ok := otpChannels[channelName]
+	if !ok {
+		return nil, 0, errOTPChannelUnhandled
+	}
+	ttl := time.Duration(cfg.OTP.CodeTTL)
+	resendInterval := time.Duration(cfg.OTP.ResendInterval)
+
+	s.mu.Lock()
+	now := time.Now()
+	s.removeExpiredLocked(now)
+	challenge := s.byKey[key]
+	destinationKey := channelName + "|" + destination
+	sent := s.byDestination[destinationKey]
+	if sent == nil {
+		sent = &otpSent{}
+		s.byDestination[destinationKey] = sent
+	}
+	if wait := sent.lastSent.Add(resendInterval).Sub(now); wait > 0 {
+		s.mu.Unlock()
+		return challenge, wait, errOTPResendTooSoon
+	}
+	if sent.sends >= cfg.OTP.MaxSends || sent.attempts >= cfg.OTP.MaxAttempts {
+		wait := sent.expires.Sub(now)
+		s.mu.Unlock()
+		return challenge, wait, errOTPTooManySends
+	}
+	code, err := newOTPCode()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, 0, err
+	}
+	previousSent, previousExpires := sent.lastSent, sent.expires
+	sent.sends++
+	sent.lastSent = now
+	sent.expires = now.Add(ttl)
+	s.mu.Unlock()
+
+	if err := channel.send(destination, code, lang, ttl); err != nil {
+		// A failed send does not count against the throttle, and the code
+		// sent before keeps working
+		s.mu.Lock()
+		sent.sends--
+		sent.lastSent = previousSent
+		sent.expires = previousExpires
+		s.mu.Unlock()
+		return nil, 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge = s.byKey[key]
+	if challenge == nil {
+		challenge = &otpChallenge{id: newReference(), key: key}
+		s.byID[challenge.id] = challenge
+		s.byKey[key] = challenge
+	}
+	challenge.channel = channelName
+	challenge.destination = destination
+	challenge.codeHash = sha256.Sum256([]byte(code))
+	challenge.expires = now.Add(ttl)
+	challenge.sent = sent
+	return challenge, 0, nil
+}
+
+// verify checks a submitted code. A challenge is consumed on success and
+// dropped once its destination runs out of attempts; new codes for the
+// destination are refused until the last one has expired.
+func (s *otpStore) verify(id, key, code string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge := s.byID[id]
+	if challenge == nil || challenge.key != key {
+		return 0, errOTPNotFound
+	}
+	if time.Now().After(challenge.expires) {
+		return 0, errOTPExpired
+	}
+	sent := challenge.sent
+	if sent.attempts >= cfg.OTP.MaxAttempts {
+		s.removeLocked(challenge)
+		return 0, errOTPTooManyAttempts
+	}
+	sent.attempts++
+	hash := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	if subtle.ConstantTimeCompare(hash[:], challenge.codeHash[:]) != 1 {
+		remaining := cfg.OTP.MaxAttempts - sent.attempts
+		if remaining <= 0 {
+			s.removeLocked(challenge)
+			return 0, errOTPTooManyAttempts
+		}
+		return remaining, errOTPInvalid
+	}
+	s.removeLocked(challenge)
+	sent.attempts = 0
+	return 0, nil
+}
+
+func (s *otpStore) removeLocked(challenge *otpChallenge) {
+	delete(s.byID, challenge.id)
+	if s.byKey[challenge.key] == challenge {
+		delete(s.byKey, challenge.key)
+	}
+}
+
+func (s *otpStore) removeExpiredLocked(now time.Time) {
+	// Keep expired challenges and destinations around for the resend
+	// interval so expiry cannot be used to skip the resend throttle
+	grace := time.Duration(cfg.OTP.ResendInterval)
+	for _, challenge := range s.byID {
+		if now.After(challenge.expires.Add(grace)) {
+			s.removeLocked(challenge)
+		}
+	}
+	for destination, sent := range s.byDestination {
+		if now.After(sent.expires.Add(grace)) {
+			delete(s.byDestination, destination)
+		}
+	}
+}
+
+// requirePossession runs the one-time code step for apps that need it. It
+// returns true when the request may go on to funding; otherwise the response
+// has been written. The first request sends a code and answers with a
+// challengeId; the client then repeats the request with challengeId and
+// otpCode.
+func requirePossession(w http.ResponseWriter, r *http.Request, appId string, order *OrderRecord, tokenAccountID string) bool {
+	channelName := cfg.OTP.Apps[appId]
+	if channelName == "" {
+		return true
+	}
+	channel, ok := otpChannels[channelName]
+	if !ok {
+		log.Printf("Unknown one-time code channel %q configured for %s", channelName, appId)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "code": "otp_unavailable", "message": "Verification is temporarily unavailable. Please try again later."})
+		return false
+	}
+	key := appId + "|" + strings.ToLower(order.OrderNo) + "|" + tokenAccountID
+
+	challengeID := r.FormValue("challengeId")
+	code := r.FormValue("otpCode")
+	if challengeID == "" || code == "" {
+		destination := channel.destination(order)
+		if destination == "" && channelName == "sms" {
+			// SMS apps serve backers whose email may not work, so there is
+			// no falling back to it
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "otp_no_destination", "message": "The phone number on file cannot receive a text message. Please contact testnet@fx.land"})
+			return false
+		}
+		if destination == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "otp_no_destination", "message": "We have no contact details on file to send a verification code to. Please contact testnet@fx.land"})
+			return false
+		}
+		challenge, wait, err := otps.issue(key, channelName, destination, requestLanguage(r))
+		switch {
+		case err == errOTPResendTooSoon || err == errOTPTooManySends:
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			response := map[string]string{"status": "error", "code": "otp_resend_throttled", "message": "A verification code was already sent. Please wait before requesting a new one."}
+			if challenge != nil {
+				response["challengeId"] = challenge.id
+			}
+			writeJSON(w, http.StatusTooManyRequests, response)
+		case err != nil:
+			log.Printf("Error sending one-time code via %s: %v", channelName, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "code": "otp_send_failed", "message": "We could not send the verification code. Please try again later."})
+		default:
+			log.Printf("One-time code %s sent via %s for %s", challenge.id, channelName, key)
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "otp_required", "code": "otp_required", "channel": channelName, "challengeId": challenge.id, "message": fmt.Sprintf("We sent a verification code to %s. Enter it to complete your registration.", channel.mask(destination))})
+		}
+		return false
+	}
+
+	remaining, err := otps.verify(challengeID, key, code)
+	switch err {
+	case nil:
+		return true
+	case errOTPInvalid:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "otp_invalid", "challengeId": challengeID, "message": fmt.Sprintf("The verification code is not correct. %d attempts remaining.", remaining)})
+	case errOTPExpired:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "otp_expired", "message": "The verification code has expired. Please request a new one."})
+	case errOTPTooManyAttempts:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "otp_too_many_attempts", "message": "Too many incorrect codes. Please request a new one."})
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "otp_not_found", "message": "No pending verification code was found. Please request a new one."})
+	}
+	return false
+}
+
+// maskEmail hides most of the local part, e.g. "j***@gmail.com".
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestOTPStore sets up a store and a channel that keeps the last code
+// sent instead of delivering it.
+func newTestOTPStore(t *testing.T) (*otpStore, *string) {
+	t.Helper()
+	cfg = defaultConfig()
+	cfg.OTP.ResendInterval = Duration(0)
+	t.Cleanup(func() {
+		cfg = defaultConfig()
+		delete(otpChannels, "test")
+	})
+	var last string
+	otpChannels["test"] = otpChannel{
+		send: func(destination, code, lang string, ttl time.Duration) error {
+			last = code
+			return nil
+		},
+	}
+	return &otpStore{
+		byID:          make(map[string]*otpChallenge),
+		byKey:         make(map[string]*otpChallenge),
+		byDestination: make(map[string]*otpSent),
+	}, &last
+}
+
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
+
+func TestOTPVerify(t *testing.T) {
+	s, last := newTestOTPStore(t)
+	challenge, _, err := s.issue("main|1001|acc", "test", "jane@example.com", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.verify(challenge.id, "main|1001|other", *last); err != errOTPNotFound {
+		t.Errorf("verify with another key: %v", err)
+	}
+	if remaining, err := s.verify(challenge.id, "main|1001|acc", wrongCode(*last)); err != errOTPInvalid || remaining != cfg.OTP.MaxAttempts-1 {
+		t.Errorf("verify wrong code = %d, %v", remaining, err)
+	}
+	if _, err := s.verify(challenge.id, "main|1001|acc", *last); err != nil {
+		t.Errorf("verify right code: %v", err)
+	}
+	if _, err := s.verify(challenge.id, "main|1001|acc", *last); err != errOTPNotFound {
+		t.Errorf("challenge not consumed: %v", err)
+	}
+}
+
+func TestOTPAttemptsSurviveResends(t *testing.T) {
+	s, last := newTestOTPStore(t)
+	key := "main|1001|acc"
+	challenge, _, _ := s.issue(key, "test", "jane@example.com", "en")
+	for i := 0; i < cfg.OTP.MaxAttempts-1; i++ {
+		s.verify(challenge.id, key, wrongCode(*last))
+	}
+	// A resend does not grant new attempts
+	challenge, _, err := s.issue(key, "test", "jane@example.com", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.verify(challenge.id, key, wrongCode(*last)); err != errOTPTooManyAttempts {
+		t.Errorf("last attempt: %v", err)
+	}
+	// The exhausted challenge is dropped and no new code is sent
+	if _, err := s.verify(challenge.id, key, *last); err != errOTPNotFound {
+		t.Errorf("exhausted challenge still usable: %v", err)
+	}
+	if _, _, err := s.issue(key, "test", "jane@example.com", "en"); err != errOTPTooManySends {
+		t.Errorf("issue after exhaustion: %v", err)
+	}
+}
+
+func TestOTPThrottledPerDestination(t *testing.T) {
+	s, _ := newTestOTPStore(t)
+	cfg.OTP.ResendInterval = Duration(time.Minute)
+	if _, _, err := s.issue("main|1001|acc1", "test", "jane@example.com", "en"); err != nil {
+		t.Fatal(err)
+	}
+	// Another account for the same destination is throttled
+	challenge, wait, err := s.issue("main|1001|acc2", "test", "jane@example.com", "en")
+	if err != errOTPResendTooSoon || wait <= 0 || challenge != nil {
+		t.Errorf("issue for another account = %v, %s, %v", challenge, wait, err)
+	}
+	if _, _, err := s.issue("main|1002|acc3", "test", "john@example.com", "en"); err != nil {
+		t.Errorf("issue to another destination: %v", err)
+	}
+}
+
+func TestOTPFailedResendKeepsCode(t *testing.T) {
+	s, last := newTestOTPStore(t)
+	key := "main|1001|acc"
+	challenge, _, err := s.issue(key, "test", "jane@example.com", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := *last
+	otpChannels["test"] = otpChannel{
+		send: func(destination, code, lang string, ttl time.Duration) error {
+			return errors.New("provider down")
+		},
+	}
+	if _, _, err := s.issue(key, "test", "jane@example.com", "en"); err == nil {
+		t.Fatal("failed send reported as sent")
+	}
+	if sent := challenge.sent; sent.sends != 1 {
+		t.Errorf("failed send counted: %d sends", sent.sends)
+	}
+	if _, err := s.verify(challenge.id, key, code); err != nil {
+		t.Errorf("code sent before the failed resend: %v", err)
+	}
+}
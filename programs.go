@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ProgramConfig defines a partner program that backers join with their
+// order, such as running a Streamr node. For every program the server serves
+// a form at Path, stores the requests in File, notifies the channels routed
+// for Event and lets the team move requests through review at /admin<Path>.
+type ProgramConfig struct {
+	// Name identifies the program in verifications and order source apps.
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	// Path defaults to /<name>, File to <name>Requests.json and Event to
+	// <name>_request.
+	Path        string             `json:"path"`
+	File        string             `json:"file"`
+	Event       string             `json:"event"`
+	Fields      []ProgramField     `json:"fields"`
+	Eligibility ProgramEligibility `json:"eligibility"`
+	// RequestsPerOrder limits the requests made with one order. Rejected
+	// requests do not count.
+	RequestsPerOrder int `json:"requestsPerOrder"`
+	// LookupField is the field requesters look up their request by. It
+	// defaults to the first unique field.
+	LookupField string `json:"lookupField"`
+	// ImportFile holds "value,orderID" lines of the lookup field registered
+	// before requests were tracked. They are imported as pending requests
+	// when File does not exist yet.
+	ImportFile string `json:"importFile"`
+}
+
+// ProgramField is a form field of a program. Values of type "address" must be
+// Ethereum addresses and are stored in EIP-55 form; "text" values are
+// checked against Pattern, a regular expression matching the whole value.
+type ProgramField struct {
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	Type      string `json:"type"`
+	Required  bool   `json:"required"`
+	Pattern   string `json:"pattern"`
+	MaxLength int    `json:"maxLength"`
+	// Unique allows one request per value.
+	Unique bool `json:"unique"`
+
+	pattern *regexp.Regexp
+}
+
+// ProgramEligibility restricts a program to some orders. Perks requires a
+// line item whose perk contains one of the strings, ignoring case, so orders
+// without perk information only qualify when Perks is empty.
+type ProgramEligibility struct {
+	MinAmount float64  `json:"minAmount"`
+	Perks     []string `json:"perks"`
+}
+
+func defaultPrograms() []ProgramConfig {
+	return []ProgramConfig{
+		{
+			Name:  "streamr",
+			Title: "Streamr node",
+			File:  "streamrRequests.json",
+			Event: EventStreamrRequest,
+			Fields: []ProgramField{
+				{Name: "streamrAccount", Label: "Streamr Account", Type: "address", Required: true, Unique: true},
+			},
+			RequestsPerOrder: 1,
+			ImportFile:       "streamr.txt",
+		},
+	}
+}
+
+// Statuses of a program request. A request starts pending, is approved or
+// rejected by the team and is provisioned once it has been set up.
+const (
+	RequestPending     = "pending"
+	RequestApproved    = "approved"
+	RequestProvisioned = "provisioned"
+	RequestRejected    = "rejected"
+)
+
+// requestTransitions lists the statuses each status can move to. A rejected
+// request can be reopened.
+var requestTransitions = map[string][]string{
+	RequestPending:  {RequestApproved, RequestRejected},
+	RequestApproved: {RequestProvisioned, RequestRejected},
+	RequestRejected: {RequestPending},
+}
+
+const programPageTemplate = "templates/program.html"
+
+var (
+	errRequestExists     = errors.New("value is already registered")
+	errRequestOrderLimit = errors.New("order has reached its request limit")
+	errRequestNotFound   = errors.New("request not found")
+)
+
+// ProgramRequest is a request to join a program. Notes are shared with the
+// requester.
+type ProgramRequest struct {
+	ID          string                `json:"id"`
+	Fields      map[string]string     `json:"fields"`
+	OrderID     string                `json:"orderId"`
+	Email       string                `json:"email"`
+	PhoneNumber string                `json:"phoneNumber"`
+	Lang        string                `json:"lang,omitempty"`
+	Status      string                `json:"status"`
+	Notes       string                `json:"notes,omitempty"`
+	History     []RequestStatusChange `json:"history"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	UpdatedAt   time.Time             `json:"updatedAt"`
+}
+
+type RequestStatusChange struct {
+	Status string    `json:"status"`
+	Notes  string    `json:"notes,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// programStore keeps the requests of a program in memory and persists them
+// to the program's file after every change.
+type programStore struct {
+	program  ProgramConfig
+	mu       sync.Mutex
+	requests []*ProgramRequest
+}
+
+// validatePrograms fills in the defaults of the programs and compiles their
+// field patterns.
+func validatePrograms(programs []ProgramConfig) error {
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	for i := range programs {
+		p := &programs[i]
+		if p.Name == "" {
+			return fmt.Errorf("program %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("program %q is defined twice", p.Name)
+		}
+		names[p.Name] = true
+		if p.Title == "" {
+			p.Title = p.Name
+		}
+		if p.Path == "" {
+			p.Path = "/" + p.Name
+		}
+		if !strings.HasPrefix(p.Path, "/") || p.Path == "/" || paths[p.Path] {
+			return fmt.Errorf("program %q has an invalid or duplicate path %q", p.Name, p.Path)
+		}
+		paths[p.Path] = true
+		if p.File == "" {
+			p.File = p.Name + "Requests.json"
+		}
+		if p.Event == "" {
+			p.Event = p.Name + "_request"
+		}
+		if p.RequestsPerOrder <= 0 {
+			p.RequestsPerOrder = 1
+		}
+
+		fields := make(map[string]bool)
+		for j := range p.Fields {
+			f := &p.Fields[j]
+			if f.Name == "" || fields[f.Name] {
+				return fmt.Errorf("program %q has a field without a name or defined twice", p.Name)
+			}
+			fields[f.Name] = true
+			switch f.Type {
+			case "":
+				f.Type = "text"
+			case "text", "address":
+			default:
+				return fmt.Errorf("field %q of program %q has unknown type %q", f.Name, p.Name, f.Type)
+			}
+			if f.Label == "" {
+				f.Label = f.Name
+			}
+			if f.MaxLength <= 0 {
+				f.MaxLength = 200
+			}
+			if f.Pattern != "" {
+				pattern, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+				if err != nil {
+					return fmt.Errorf("field %q of program %q: %v", f.Name, p.Name, err)
+				}
+				f.pattern = pattern
+			}
+			if p.LookupField == "" && f.Unique {
+				p.LookupField = f.Name
+			}
+		}
+		if p.LookupField == "" {
+			return fmt.Errorf("program %q needs a unique field to look up requests by", p.Name)
+		}
+		if p.field(p.LookupField) == nil {
+			return fmt.Errorf("lookup field %q of program %q is not defined", p.LookupField, p.Name)
+		}
+	}
+	return nil
+}
+
+func (p *ProgramConfig) field(name string) *ProgramField {
+	for i := range p.Fields {
+		if p.Fields[i].Name == name {
+			return &p.Fields[i]
+		}
+	}
+	return nil
+}
+
+// normalize checks a submitted value and returns the form it is stored in.
+func (f ProgramField) normalize(value string) (string, bool) {
+	value = sanitizeInput(value)
+	if value == "" {
+		return "", !f.Required
+	}
+	if utf8.RuneCountInString(value) > f.MaxLength {
+		return "", false
+	}
+	if f.Type == "address" {
+		var ok bool
+		if value, ok = normalizeAddress(value); !ok {
+			return "", false
+		}
+	}
+	if f.pattern != nil && !f.pattern.MatchString(value) {
+		return "", false
+	}
+	return value, true
+}
+
+func (e ProgramEligibility) allows(order OrderRecord) bool {
+	if order.Amount < e.MinAmount && !order.AmountUnknown {
+		return false
+	}
+	if len(e.Perks) == 0 {
+		return true
+	}
+	for _, item := range order.LineItems {
+		for _, perk := range e.Perks {
+			if perk != "" && strings.Contains(strings.ToLower(item.Perk), strings.ToLower(perk)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// registerPrograms loads the requests of every program and serves its
+// endpoints.
+func registerPrograms(programs []ProgramConfig) error {
+	for _, program := range programs {
+		s := &programStore{program: program}
+		if err := s.load(); err != nil {
+			return fmt.Errorf("error loading %s requests: %v", program.Name, err)
+		}
+		http.HandleFunc(program.Path, s.submitHandler)
+		http.HandleFunc(program.Path+"/status", s.statusHandler)
+		http.HandleFunc("/admin"+program.Path, requireAdmin(s.adminHandler))
+		apiRoutes = append(apiRoutes, s.apiRoutes()...)
+	}
+	return nil
+}
+
+// apiRoutes describes the program's submit and status endpoints for the
+// versioned API.
+func (s *programStore) apiRoutes() []apiRoute {
+	p := s.program
+	params := []apiParam{
+		{Name: "email", Required: true, Description: "Email of the order"},
+		{Name: "orderId", Required: true},
+		{Name: "phoneNumber", Required: true, Description: "At least the last 4 digits of the shipping phone"},
+	}
+	for _, f := range p.Fields {
+		params = append(params, apiParam{Name: f.Name, Required: f.Required, Description: f.Label})
+	}
+	params = append(params, apiParam{Name: "lang", Description: "Language of the emails"})
+	lookup := p.field(p.LookupField)
+	return []apiRoute{
+		{
+			Method:  "POST",
+			Path:    "/programs/" + p.Name,
+			Summary: fmt.Sprintf("Submit a %s request", p.Title),
+			Form:    true,
+			Params:  params,
+			Data:    []apiParam{{Name: "requestId"}, {Name: "message"}},
+			Errors: []string{"invalid_field", "invalid_phone", "order_not_matched", "order_refunded", "amount_too_low",
+				"not_eligible", "already_registered", "order_limit_reached"},
+			Handler: s.submitHandler,
+		},
+		{
+			Method:  "GET",
+			Path:    "/programs/" + p.Name + "/status",
+			Summary: fmt.Sprintf("Look up a %s request", p.Title),
+			Params:  []apiParam{{Name: lookup.Name, Required: true, Description: lookup.Label}},
+			Data: []apiParam{
+				{Name: lookup.Name},
+				{Name: "requestStatus", Description: "pending, approved, provisioned or rejected"},
+				{Name: "notes"},
+				{Name: "updatedAt"},
+			},
+			Errors:  []string{"request_not_found"},
+			Handler: s.statusHandler,
+		},
+	}
+}
+
+func (s *programStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.program.File)
+	if err == nil {
+		return json.Unmarshal(data, &s.requests)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if s.program.ImportFile == "" {
+		return nil
+	}
+	return s.importLocked()
+}
+
+// importLocked imports the "value,orderID" lines of the import file as
+// pending requests.
+func (s *programStore) importLocked() error {
+	file, err := os.Open(s.program.ImportFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	field := s.program.field(s.program.LookupField)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, orderID, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ",")
+		if value == "" {
+			continue
+		}
+		if normalized, ok := field.normalize(value); ok {
+			value = normalized
+		}
+		s.requests = append(s.requests, &ProgramRequest{
+			ID:        newReference(),
+			Fields:    map[string]string{field.Name: value},
+			OrderID:   orderID,
+			Status:    RequestPending,
+			History:   []RequestStatusChange{{Status: RequestPending, Time: info.ModTime()}},
+			CreatedAt: info.ModTime(),
+			UpdatedAt: info.ModTime(),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(s.requests) > 0 {
+		log.Printf("Imported %d %s requests from %s", len(s.requests), s.program.Name, s.program.ImportFile)
+		return s.saveLocked()
+	}
+	return nil
+}
+
+func (s *programStore) saveLocked() error {
+	data, err := json.Marshal(s.requests)
+	if err != nil {
+		return err
+	}
+	tmp := s.program.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.program.File)
+}
+
+// findLocked looks up a request by the normalized value of a field.
+func (s *programStore) findLocked(field, value string) *ProgramRequest {
+	for _, request := range s.requests {
+		if request.Fields[field] == value {
+			return request
+		}
+	}
+	return nil
+}
+
+func (s *programStore) orderRequestsLocked(orderID string) int {
+	count := 0
+	for _, request := range s.requests {
+		if request.Status != RequestRejected && strings.EqualFold(request.OrderID, orderID) {
+			count++
+		}
+	}
+	return count
+}
+
+// checkLocked reports why a request could not be added: a unique field whose
+// value is already registered, or the order limit.
+func (s *programStore) checkLocked(request ProgramRequest) (*ProgramField, error) {
+	for i, f := range s.program.Fields {
+		if f.Unique && request.Fields[f.Name] != "" && s.findLocked(f.Name, request.Fields[f.Name]) != nil {
+			return &s.program.Fields[i], errRequestExists
+		}
+	}
+	if s.orderRequestsLocked(request.OrderID) >= s.program.RequestsPerOrder {
+		return nil, errRequestOrderLimit
+	}
+	return nil, nil
+}
+
+// add stores a new pending request if the checks still pass.
+func (s *programStore) add(request ProgramRequest) (ProgramRequest, *ProgramField, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if field, err := s.checkLocked(request); err != nil {
+		return ProgramRequest{}, field, err
+	}
+	now := time.Now().UTC()
+	request.ID = newReference()
+	request.Status = RequestPending
+	request.History = []RequestStatusChange{{Status: RequestPending, Time: now}}
+	request.CreatedAt = now
+	request.UpdatedAt = now
+	s.requests = append(s.requests, &request)
+	if err := s.saveLocked(); err != nil {
+		s.requests = s.requests[:len(s.requests)-1]
+		return ProgramRequest{}, nil, err
+	}
+	return request, nil, nil
+}
+
+// transition moves a request to a new status if the current status allows it.
+func (s *programStore) transition(id, status, notes string) (ProgramRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var request *ProgramRequest
+	for _, r := range s.requests {
+		if r.ID == id {
+			request = r
+		}
+	}
+	if request == nil {
+		return ProgramRequest{}, errRequestNotFound
+	}
+	allowed := false
+	for _, next := range requestTransitions[request.Status] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return ProgramRequest{}, fmt.Errorf("a %s request cannot be %s", request.Status, status)
+	}
+	// Reopening counts against the order again
+	if request.Status == RequestRejected && s.orderRequestsLocked(request.OrderID) >= s.program.RequestsPerOrder {
+		return ProgramRequest{}, errRequestOrderLimit
+	}
+
+	previous := *request
+	now := time.Now().UTC()
+	request.Status = status
+	request.Notes = notes
+	request.UpdatedAt = now
+	request.History = append(request.History, RequestStatusChange{Status: status, Notes: notes, Time: now})
+	if err := s.saveLocked(); err != nil {
+		*request = previous
+		return ProgramRequest{}, err
+	}
+	return *request, nil
+}
+
+// sendStatusEmail tells the requester about a status change, with the
+// <name>_status template if there is one, otherwise program_status.
+func (s *programStore) sendStatusEmail(request ProgramRequest) {
+	if request.Email == "" {
+		return
+	}
+	name := s.program.Name + "_status"
+	if !fileExists(filepath.Join(cfg.Email.TemplatesDir, cfg.Email.DefaultLanguage, name+".txt")) {
+		name = "program_status"
+	}
+	err := sendTemplatedEmail(name, request.Lang, []ToEmail{{Email: request.Email, Name: strings.Split(request.Email, "@")[0]}}, struct {
+		ProgramRequest
+		Title string
+		Key   string
+	}{request, s.program.Title, request.Fields[s.program.LookupField]})
+	if err != nil {
+		log.Printf("Error sending %s status email: %v", s.program.Name, err)
+	}
+}
+
+// submitHandler serves the program's form and takes requests. The order is
+// verified like a registration, then the request is stored under the order
+// number of the matched order and the team notified.
+func (s *programStore) submitHandler(w http.ResponseWriter, r *http.Request) {
+	p := s.program
+	if r.Method != "POST" {
+		page, err := htmltemplate.ParseFiles(programPageTemplate)
+		if err != nil {
+			log.Println("Error loading program page:", err)
+			http.Error(w, "Error loading page", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, p); err != nil {
+			log.Println("Error rendering program page:", err)
+		}
+		return
+	}
+
+	email := r.FormValue("email")
+	orderID := r.FormValue("orderId")
+	phoneNumber := r.FormValue("phoneNumber")
+	request := ProgramRequest{
+		Fields:      make(map[string]string),
+		Email:       email,
+		PhoneNumber: phoneNumber,
+		Lang:        requestLanguage(r),
+	}
+	for _, f := range p.Fields {
+		value, ok := f.normalize(r.FormValue(f.Name))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "invalid_field", "field": f.Name, "message": fmt.Sprintf("Please enter a valid %s.", f.Label)})
+			return
+		}
+		if value != "" {
+			request.Fields[f.Name] = value
+		}
+	}
+
+	if !requireRateLimit(w, ipKey(r), emailKey(email), orderKey(orderID), accountKey(request.Fields[p.LookupField])) {
+		return
+	}
+
+	result := verifyOrder(p.Name, email, orderID, phoneNumber)
+	if !result.Matched {
+		respondVerificationFailure(w, r, p.Name, email, orderID, phoneNumber, result)
+		return
+	}
+	recordVerification(r, p.Name, email, orderID, phoneNumber, result, false)
+	if !p.Eligibility.allows(*result.Order) {
+		writeJSONError(w, http.StatusBadRequest, "not_eligible", fmt.Sprintf("This order is not eligible for the %s program. If you think this is a mistake please contact testnet@fx.land", p.Title))
+		return
+	}
+
+	// Track the request so the team can move it through review and setup
+	request.OrderID = result.Order.OrderNo
+	request, field, err := s.add(request)
+	if !s.respondCheckFailure(w, field, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving %s request: %v", p.Name, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error processing your request. Please try again later.")
+		return
+	}
+
+	// Let the team know through the channels routed for the program
+	fields := []NotificationField{{"Email", email}, {"Order ID", request.OrderID}, {"Phone Number", phoneNumber}}
+	for _, f := range p.Fields {
+		fields = append(fields, NotificationField{f.Label, request.Fields[f.Name]})
+	}
+	go notify(p.Event, fmt.Sprintf("New %s request", p.Title), fields...)
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":    "success",
+		"requestId": request.ID,
+		"message":   fmt.Sprintf("Your %s request has been submitted successfully. You can check its status with your %s.", p.Title, p.field(p.LookupField).Label),
+	})
+}
+
+// respondCheckFailure answers a failed store check and returns false, or
+// returns true when the check passed or failed for another reason.
+func (s *programStore) respondCheckFailure(w http.ResponseWriter, field *ProgramField, err error) bool {
+	switch {
+	case errors.Is(err, errRequestExists):
+		writeJSONError(w, http.StatusBadRequest, "already_registered", fmt.Sprintf("This %s is already registered.", field.Label))
+		return false
+	case errors.Is(err, errRequestOrderLimit):
+		writeJSONError(w, http.StatusBadRequest, "order_limit_reached", fmt.Sprintf("This order has already been used for a %s request. If you think this is a mistake please contact testnet@fx.land", s.program.Title))
+		return false
+	}
+	return true
+}
+
+// statusHandler lets requesters look up their request by the lookup field,
+// e.g. /streamr/status?streamrAccount=0x... Contact details and the order
+// are not shown.
+func (s *programStore) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if !requireRateLimit(w, ipKey(r)) {
+		return
+	}
+	field := s.program.field(s.program.LookupField)
+	value, valid := field.normalize(r.URL.Query().Get(field.Name))
+	s.mu.Lock()
+	var request ProgramRequest
+	found := s.findLocked(field.Name, value)
+	if found != nil {
+		request = *found
+	}
+	s.mu.Unlock()
+	if !valid || value == "" || found == nil {
+		writeJSONError(w, http.StatusNotFound, "request_not_found", fmt.Sprintf("No %s request was found for this %s.", s.program.Title, field.Label))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":        "success",
+		field.Name:      value,
+		"requestStatus": request.Status,
+		"notes":         request.Notes,
+		"updatedAt":     request.UpdatedAt.Format(time.RFC3339),
+	})
+}
+
+// adminHandler lists the program's requests, newest first, optionally
+// filtered by status and by the value of any field, and changes their
+// status:
+//
+//	POST /admin/streamr {"id": "...", "status": "approved", "notes": "..."}
+func (s *programStore) adminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		requests := []ProgramRequest{}
+		s.mu.Lock()
+		for _, request := range s.requests {
+			if status := query.Get("status"); status != "" && request.Status != status {
+				continue
+			}
+			matched := true
+			for _, f := range s.program.Fields {
+				if value := strings.TrimSpace(query.Get(f.Name)); value != "" && !strings.EqualFold(request.Fields[f.Name], value) {
+					matched = false
+				}
+			}
+			if matched {
+				requests = append(requests, *request)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt.After(requests[j].CreatedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requests)
+	case "POST":
+		var data struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Notes  string `json:"notes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request, err := s.transition(data.ID, data.Status, sanitizeInput(data.Notes))
+		if errors.Is(err, errRequestNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("%s request %s for %s is now %s", s.program.Title, request.ID, request.Fields[s.program.LookupField], request.Status)
+		go s.sendStatusEmail(request)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(request)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestProgramStore sets up the default streamr program in an empty
+// directory.
+func newTestProgramStore(t *testing.T) *programStore {
+	t.Helper()
+	inTempDir(t)
+	programs := defaultPrograms()
+	if err := validatePrograms(programs); err != nil {
+		t.Fatal(err)
+	}
+	return &programStore{program: programs[0]}
+}
+
+func TestProgramRequestTransitions(t *testing.T) {
+	s := newTestProgramStore(t)
+	request, _, err := s.add(ProgramRequest{Fields: map[string]string{"streamrAccount": "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"}, OrderID: "1001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		status string
+		ok     bool
+	}{
+		{RequestProvisioned, false},
+		{RequestApproved, true},
+		{RequestPending, false},
+		{RequestRejected, true},
+		{RequestPending, true},
+		{RequestApproved, true},
+		{RequestProvisioned, true},
+		{RequestRejected, false},
+		{"done", false},
+	}
+	for _, tt := range tests {
+		if _, err := s.transition(request.ID, tt.status, "notes for "+tt.status); (err == nil) != tt.ok {
+			t.Errorf("transition to %s: %v", tt.status, err)
+		}
+	}
+	if _, err := s.transition("unknown", RequestApproved, ""); err != errRequestNotFound {
+		t.Errorf("unknown request: %v", err)
+	}
+
+	// The history survives a restart
+	restarted := &programStore{program: s.program}
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	got := restarted.findLocked("streamrAccount", "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf")
+	if got == nil || got.Status != RequestProvisioned || len(got.History) != 6 || got.Notes != "notes for provisioned" {
+		t.Errorf("after restart: %+v", got)
+	}
+}
+
+func TestProgramRequestImport(t *testing.T) {
+	s := newTestProgramStore(t)
+	lines := "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf,1001\n\nnot-an-address,1002\n"
+	if err := os.WriteFile("streamr.txt", []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.requests) != 2 {
+		t.Fatalf("imported %d requests; want 2", len(s.requests))
+	}
+	imported := s.findLocked("streamrAccount", "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf")
+	if imported == nil || imported.OrderID != "1001" || imported.Status != RequestPending {
+		t.Errorf("imported request: %+v", imported)
+	}
+	if s.findLocked("streamrAccount", "not-an-address") == nil {
+		t.Error("line with an invalid value not imported as is")
+	}
+
+	// Once the requests file exists the import file is not read again
+	os.WriteFile("streamr.txt", []byte("0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF,1003\n"), 0644)
+	restarted := &programStore{program: s.program}
+	if err := restarted.load(); err != nil || len(restarted.requests) != 2 {
+		t.Errorf("after restart: %d requests, %v", len(restarted.requests), err)
+	}
+}
+
+func TestProgramFieldNormalize(t *testing.T) {
+	programs := []ProgramConfig{{
+		Name: "test",
+		Fields: []ProgramField{
+			{Name: "account", Type: "address", Required: true, Unique: true},
+			{Name: "node", Pattern: "[a-z0-9-]+", MaxLength: 10},
+		},
+	}}
+	if err := validatePrograms(programs); err != nil {
+		t.Fatal(err)
+	}
+	account, node := *programs[0].field("account"), *programs[0].field("node")
+	tests := []struct {
+		name  string
+		field ProgramField
+		value string
+		want  string
+		ok    bool
+	}{
+		{"lowercase address", account, "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf", "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", true},
+		{"address with spaces", account, "  0x7E5F4552091A69125D5DFCB7B8C2659029395BDF ", "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", true},
+		{"bad checksum", account, "0x7E5F4552091A69125d5DfCb7b8C2659029395BDf", "", false},
+		{"short address", account, "0x7e5f4552091a69125d5dfcb7b8c2659029395b", "", false},
+		{"not hex", account, "0x7e5f4552091a69125d5dfcb7b8c2659029395bzz", "", false},
+		{"missing required", account, "  ", "", false},
+		{"missing optional", node, "", "", true},
+		{"matches pattern", node, "node-1", "node-1", true},
+		{"partial pattern match", node, "node 1", "", false},
+		{"too long", node, "node-12345678", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.field.normalize(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: normalize = %q, %t; want %q, %t", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestProgramRequestLimits(t *testing.T) {
+	s := newTestProgramStore(t)
+	s.program.RequestsPerOrder = 2
+	accounts := []string{
+		"0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf",
+		"0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF",
+		"0x6813Eb9362372EEF6200f3b1dbC3f819671cBA69",
+	}
+	add := func(account, orderID string) (ProgramRequest, error) {
+		request, _, err := s.add(ProgramRequest{Fields: map[string]string{"streamrAccount": account}, OrderID: orderID})
+		return request, err
+	}
+
+	first, err := add(accounts[0], "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := add(accounts[0], "1002"); err != errRequestExists {
+		t.Errorf("registered account accepted again: %v", err)
+	}
+	if _, err := add(accounts[1], "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := add(accounts[2], "1001"); err != errRequestOrderLimit {
+		t.Errorf("third request for the order: %v", err)
+	}
+
+	// A rejected request frees its slot, and cannot be reopened while the
+	// order is at its limit
+	if _, err := s.transition(first.ID, RequestRejected, ""); err != nil {
+		t.Fatal(err)
+	}
+	third, err := add(accounts[2], "1001")
+	if err != nil {
+		t.Fatalf("request after a rejection: %v", err)
+	}
+	if _, err := s.transition(first.ID, RequestPending, ""); err != errRequestOrderLimit {
+		t.Errorf("reopened beyond the order limit: %v", err)
+	}
+	if _, err := s.transition(third.ID, RequestRejected, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.transition(first.ID, RequestPending, ""); err != nil {
+		t.Errorf("reopening with a free slot: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig throttles the endpoints that verify orders or check NFT
+// ownership, so the last digits of a phone number cannot be guessed and the
+// OpenSea quota cannot be drained. Requests are counted in token buckets per
+// client IP and per submitted email, order ID and account.
+type RateLimitConfig struct {
+	Enabled bool `json:"enabled"`
+	// TrustedProxies lists the addresses or CIDR ranges of reverse proxies.
+	// The client IP is read from X-Forwarded-For only for requests coming
+	// through them.
+	TrustedProxies []string  `json:"trustedProxies"`
+	IP             RateLimit `json:"ip"`
+	Email          RateLimit `json:"email"`
+	Order          RateLimit `json:"order"`
+	Account        RateLimit `json:"account"`
+}
+
+// RateLimit allows Burst requests at once, refilled at one request per
+// Interval. A Burst of 0 turns the limit off.
+type RateLimit struct {
+	Burst    int      `json:"burst"`
+	Interval Duration `json:"interval"`
+}
+
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled:        true,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+		IP:             RateLimit{Burst: 30, Interval: Duration(6 * time.Second)},
+		Email:          RateLimit{Burst: 10, Interval: Duration(5 * time.Minute)},
+		Order:          RateLimit{Burst: 10, Interval: Duration(5 * time.Minute)},
+		Account:        RateLimit{Burst: 10, Interval: Duration(5 * time.Minute)},
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps the buckets in memory, keyed by kind and value, e.g.
+// "email:jane@example.com". Buckets that have filled up again are dropped.
+type rateLimiter struct {
+	mu         sync.Mutex
+	limits     map[string]RateLimit
+	proxies    []*net.IPNet
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+var rateLimits = &rateLimiter{}
+
+// rateKey is a value to count a request against, such as the submitted email.
+type rateKey struct {
+	kind  string
+	value string
+}
+
+func ipKey(r *http.Request) rateKey { return rateKey{"ip", clientIP(r)} }
+
+func emailKey(email string) rateKey {
+	return rateKey{"email", canonicalEmail(email)}
+}
+
+func orderKey(orderID string) rateKey {
+	return rateKey{"order", strings.ToLower(sanitizeInput(orderID))}
+}
+
+func accountKey(account string) rateKey {
+	return rateKey{"account", strings.ToLower(strings.TrimSpace(account))}
+}
+
+// configureRateLimits checks the config and sets up the limiter.
+func configureRateLimits(c RateLimitConfig) error {
+	limits := map[string]RateLimit{"ip": c.IP, "email": c.Email, "order": c.Order, "account": c.Account}
+	for kind, limit := range limits {
+		if limit.Burst < 0 || (limit.Burst > 0 && limit.Interval <= 0) {
+			return fmt.Errorf("%s limit needs a positive burst and interval", kind)
+		}
+	}
+	var proxies []*net.IPNet
+	for _, p := range c.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		proxies = append(proxies, network)
+	}
+
+	rateLimits.mu.Lock()
+	defer rateLimits.mu.Unlock()
+	rateLimits.limits = limits
+	if !c.Enabled {
+		rateLimits.limits = nil
+	}
+	rateLimits.proxies = proxies
+	rateLimits.buckets = make(map[string]*tokenBucket)
+	return nil
+}
+
+// allow takes a token from the bucket of every key, or from none when one of
+// them is empty. It returns how long to wait in that case.
+func (l *rateLimiter) allow(keys ...rateKey) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.pruneLocked(now)
+
+	var takes []*tokenBucket
+	var wait time.Duration
+	for _, key := range keys {
+		limit := l.limits[key.kind]
+		if limit.Burst == 0 || key.value == "" {
+			continue
+		}
+		name := key.kind + ":" + key.value
+		bucket := l.buckets[name]
+		if bucket == nil {
+			bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+			l.buckets[name] = bucket
+		}
+		interval := time.Duration(limit.Interval)
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+float64(now.Sub(bucket.updated))/float64(interval))
+		bucket.updated = now
+		if bucket.tokens < 1 {
+			if w := time.Duration((1 - bucket.tokens) * float64(interval)); w > wait {
+				wait = w
+			}
+			log.Printf("Rate limit reached for %s", name)
+		}
+		takes = append(takes, bucket)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, bucket := range takes {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// pruneLocked drops the buckets that are full again, once a minute.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPruned) < time.Minute {
+		return
+	}
+	l.lastPruned = now
+	for name, bucket := range l.buckets {
+		limit := l.limits[name[:strings.IndexByte(name, ':')]]
+		refilled := bucket.tokens + float64(now.Sub(bucket.updated))/float64(limit.Interval)
+		if limit.Burst == 0 || refilled >= float64(limit.Burst) {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+// requireRateLimit counts the request against the keys. It returns true when
+// the request may go on; otherwise it answers 429 with Retry-After.
+func requireRateLimit(w http.ResponseWriter, keys ...rateKey) bool {
+	ok, wait := rateLimits.allow(keys...)
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests. Please wait a few minutes and try again.")
+	return false
+}
+
+// clientIP returns the address of the client. Behind trusted proxies it is
+// the last address in X-Forwarded-For that is not a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !rateLimits.trusted(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !rateLimits.trusted(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func (l *rateLimiter) trusted(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, network := range l.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
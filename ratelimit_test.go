@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testRateLimits(t *testing.T, c RateLimitConfig) {
+	t.Helper()
+	if err := configureRateLimits(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { configureRateLimits(defaultRateLimitConfig()) })
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	c := defaultRateLimitConfig()
+	c.Email = RateLimit{Burst: 3, Interval: Duration(time.Minute)}
+	c.Order = RateLimit{Burst: 1, Interval: Duration(time.Minute)}
+	c.Account = RateLimit{}
+	testRateLimits(t, c)
+	jane, john, order := emailKey("jane@example.com"), emailKey("john@example.com"), orderKey("1001")
+
+	tests := []struct {
+		name string
+		keys []rateKey
+		want bool
+	}{
+		{"burst 1", []rateKey{jane}, true},
+		{"burst 2", []rateKey{jane}, true},
+		{"burst 3", []rateKey{jane}, true},
+		{"burst spent", []rateKey{jane}, false},
+		{"other email", []rateKey{john}, true},
+		{"same email in other case", []rateKey{emailKey("Jane@Example.com")}, false},
+		{"empty value not counted", []rateKey{emailKey("")}, true},
+		{"disabled kind not counted", []rateKey{accountKey("0xabc"), accountKey("0xabc")}, true},
+		// john has tokens left but the order has none after this
+		{"order and email", []rateKey{order, john}, true},
+		{"order spent", []rateKey{john, order}, false},
+	}
+	for _, tt := range tests {
+		ok, wait := rateLimits.allow(tt.keys...)
+		if ok != tt.want {
+			t.Errorf("%s: allow = %t; want %t", tt.name, ok, tt.want)
+		}
+		if !ok && (wait <= 0 || wait > time.Minute) {
+			t.Errorf("%s: wait = %v", tt.name, wait)
+		}
+	}
+
+	// The refused take above left john's tokens alone: one taken, one left
+	if ok, _ := rateLimits.allow(john); !ok {
+		t.Error("refused request took a token from john")
+	}
+	if ok, _ := rateLimits.allow(john); ok {
+		t.Error("john allowed beyond the burst")
+	}
+
+	// One interval later one token is back, and no more than the burst
+	rateLimits.mu.Lock()
+	rateLimits.buckets["email:jane@example.com"].updated = time.Now().Add(-time.Minute)
+	rateLimits.buckets["email:john@example.com"].updated = time.Now().Add(-time.Hour)
+	rateLimits.mu.Unlock()
+	if ok, _ := rateLimits.allow(jane); !ok {
+		t.Error("token not refilled after one interval")
+	}
+	if ok, _ := rateLimits.allow(jane); ok {
+		t.Error("more than one token refilled after one interval")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := rateLimits.allow(john); !ok {
+			t.Fatalf("john refused after refill, request %d", i+1)
+		}
+	}
+	if ok, _ := rateLimits.allow(john); ok {
+		t.Error("refill went beyond the burst")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	c := defaultRateLimitConfig()
+	c.Enabled = false
+	c.Email = RateLimit{Burst: 1, Interval: Duration(time.Minute)}
+	testRateLimits(t, c)
+	for i := 0; i < 3; i++ {
+		if ok, _ := rateLimits.allow(emailKey("jane@example.com")); !ok {
+			t.Fatalf("request %d refused while disabled", i+1)
+		}
+	}
+}
+
+func TestConfigureRateLimits(t *testing.T) {
+	tests := map[string]func(*RateLimitConfig){
+		"negative burst":    func(c *RateLimitConfig) { c.IP.Burst = -1 },
+		"no interval":       func(c *RateLimitConfig) { c.Email.Interval = 0 },
+		"bad proxy":         func(c *RateLimitConfig) { c.TrustedProxies = []string{"proxy.local"} },
+		"bad proxy network": func(c *RateLimitConfig) { c.TrustedProxies = []string{"10.0.0.0/33"} },
+	}
+	for name, change := range tests {
+		c := defaultRateLimitConfig()
+		change(&c)
+		if err := configureRateLimits(c); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	configureRateLimits(defaultRateLimitConfig())
+}
+
+func TestClientIP(t *testing.T) {
+	c := defaultRateLimitConfig()
+	c.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8", "::1"}
+	testRateLimits(t, c)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer sends XFF", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"through proxy", "127.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"through proxy without XFF", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"spoofed leftmost hop", "127.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "127.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"repeated headers", "127.0.0.1:5000", []string{"1.2.3.4", "198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"garbage hop stops the walk", "127.0.0.1:5000", []string{"198.51.100.1, junk, 10.1.2.3"}, "10.1.2.3"},
+		{"only proxies", "127.0.0.1:5000", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"ipv6 proxy", "[::1]:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %s; want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequireRateLimit(t *testing.T) {
+	c := defaultRateLimitConfig()
+	c.Order = RateLimit{Burst: 1, Interval: Duration(90 * time.Second)}
+	testRateLimits(t, c)
+
+	w := httptest.NewRecorder()
+	if !requireRateLimit(w, orderKey("1001")) {
+		t.Fatal("first request refused")
+	}
+	w = httptest.NewRecorder()
+	if requireRateLimit(w, orderKey(" 1001 ")) {
+		t.Fatal("second request allowed")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d; want 429", w.Code)
+	}
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retry < 89 || retry > 90 {
+		t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+}
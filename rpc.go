@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChainConfig describes how to reach an EVM chain over JSON-RPC. A local dev
+// chain such as anvil or hardhat can be configured like any other chain.
+// DelegateRegistry defaults to the delegate.xyz v2 registry.
+type ChainConfig struct {
+	RPCURL           string `json:"rpcUrl"`
+	DelegateRegistry string `json:"delegateRegistry"`
+}
+
+// Function selectors of the contract calls used to check ownership.
+const (
+	selectorBalanceOf           = "70a08231" // balanceOf(address)
+	selectorBalanceOf1155       = "00fdd58e" // balanceOf(address,uint256)
+	selectorOwnerOf             = "6352211e" // ownerOf(uint256)
+	selectorTokenOfOwnerByIndex = "2f745c59" // tokenOfOwnerByIndex(address,uint256)
+	selectorSupportsInterface   = "01ffc9a7" // supportsInterface(bytes4)
+)
+
+// interfaceERC721Enumerable is the ERC-165 interface ID of the ERC-721
+// enumeration extension, which provides tokenOfOwnerByIndex.
+const interfaceERC721Enumerable = "780e9d63"
+
+// rpcBatchSize is the number of calls sent in one JSON-RPC batch.
+const rpcBatchSize = 100
+
+var rpcClient = &http.Client{Timeout: 30 * time.Second}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// rpcCallResult is the outcome of one eth_call. Err is set when the call
+// reverted, e.g. ownerOf for a token that does not exist.
+type rpcCallResult struct {
+	Value *big.Int
+	Err   error
+}
+
+// ethCalls runs the eth_calls against the contract at the block ("latest" or
+// a hex block number) in JSON-RPC batches and returns their results in order.
+// The returned error means the endpoint could not be used at all.
+func ethCalls(rpcURL, block, contract string, calls []string) ([]rpcCallResult, error) {
+	results := make([]rpcCallResult, len(calls))
+	for start := 0; start < len(calls); start += rpcBatchSize {
+		end := start + rpcBatchSize
+		if end > len(calls) {
+			end = len(calls)
+		}
+		var batch []rpcRequest
+		for i := start; i < end; i++ {
+			batch = append(batch, rpcRequest{
+				JSONRPC: "2.0",
+				ID:      i,
+				Method:  "eth_call",
+				Params:  []any{map[string]string{"to": contract, "data": "0x" + calls[i]}, block},
+			})
+		}
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := doWithBackoff(rpcClient, defaultBackoff, func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", rpcURL, bytes.NewReader(payload))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			return req, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, statusError(resp, body)
+		}
+
+		var responses []rpcResponse
+		if err := json.Unmarshal(body, &responses); err != nil {
+			return nil, fmt.Errorf("error parsing JSON-RPC response: %v", err)
+		}
+		answered := make(map[int]bool)
+		for _, r := range responses {
+			if r.ID < start || r.ID >= end {
+				continue
+			}
+			answered[r.ID] = true
+			if r.Error != nil {
+				results[r.ID].Err = fmt.Errorf("eth_call failed: %s (code %d)", r.Error.Message, r.Error.Code)
+				continue
+			}
+			var data string
+			if err := json.Unmarshal(r.Result, &data); err != nil {
+				return nil, fmt.Errorf("error parsing eth_call result: %v", err)
+			}
+			value, ok := new(big.Int).SetString(strings.TrimPrefix(data, "0x"), 16)
+			if !ok {
+				// An empty result means the contract does not implement the function
+				results[r.ID].Err = fmt.Errorf("eth_call returned no data")
+				continue
+			}
+			results[r.ID].Value = value
+		}
+		if len(answered) != end-start {
+			return nil, fmt.Errorf("JSON-RPC batch answered %d of %d calls", len(answered), end-start)
+		}
+	}
+	return results, nil
+}
+
+// rpcCall makes a single JSON-RPC call and decodes its result.
+func rpcCall(rpcURL, method string, params []any, result any) error {
+	payload, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp, err := doWithBackoff(rpcClient, defaultBackoff, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", rpcURL, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp, body)
+	}
+	var response rpcResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("error parsing JSON-RPC response: %v", err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s failed: %s (code %d)", method, response.Error.Message, response.Error.Code)
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// abiAddress encodes an address as a 32-byte ABI word.
+func abiAddress(address string) (string, error) {
+	raw := strings.TrimPrefix(strings.ToLower(address), "0x")
+	if len(raw) != 40 {
+		return "", fmt.Errorf("invalid address %q", address)
+	}
+	if _, err := hex.DecodeString(raw); err != nil {
+		return "", fmt.Errorf("invalid address %q", address)
+	}
+	return strings.Repeat("0", 24) + raw, nil
+}
+
+// abiUint encodes an unsigned integer as a 32-byte ABI word.
+func abiUint(n *big.Int) string {
+	return fmt.Sprintf("%064x", n)
+}
+
+// rpcTokenIDs lists the eligible token IDs of the collection held by the
+// address by calling the contract directly:
+//   - ERC-721 with token ID ranges: ownerOf for every ID in the ranges
+//   - ERC-721 without ranges: balanceOf, then tokenOfOwnerByIndex, which
+//     needs the contract to be enumerable
+//   - ERC-1155: balanceOf(address, id) for every ID in the ranges
+func rpcTokenIDs(collection NFTCollection, address string) ([]string, error) {
+	chain, ok := cfg.NFT.Chains[collection.Chain]
+	if !ok || chain.RPCURL == "" {
+		return nil, fmt.Errorf("no JSON-RPC endpoint configured for chain %q", collection.Chain)
+	}
+	owner, err := abiAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := collection.rangeTokenIDs(maxRangeTokenIDs)
+	if collection.Standard == "erc1155" || len(ids) > 0 {
+		var calls []string
+		for _, id := range ids {
+			if collection.Standard == "erc1155" {
+				calls = append(calls, selectorBalanceOf1155+owner+abiUint(id))
+			} else {
+				calls = append(calls, selectorOwnerOf+abiUint(id))
+			}
+		}
+		results, err := ethCalls(chain.RPCURL, "latest", collection.Contract, calls)
+		if err != nil {
+			return nil, err
+		}
+		ownerValue, _ := new(big.Int).SetString(owner, 16)
+		var tokenIDs []string
+		for i, result := range results {
+			// ownerOf reverts for tokens that were never minted or were burned
+			if result.Err != nil {
+				continue
+			}
+			if collection.Standard == "erc1155" && result.Value.Sign() > 0 ||
+				collection.Standard != "erc1155" && result.Value.Cmp(ownerValue) == 0 {
+				tokenIDs = append(tokenIDs, ids[i].String())
+			}
+		}
+		return tokenIDs, nil
+	}
+
+	results, err := ethCalls(chain.RPCURL, "latest", collection.Contract, []string{selectorBalanceOf + owner})
+	if err != nil {
+		return nil, err
+	}
+	if results[0].Err != nil {
+		return nil, results[0].Err
+	}
+	balance := results[0].Value
+	if balance.Sign() == 0 {
+		return nil, nil
+	}
+	if !balance.IsInt64() || balance.Int64() > maxRangeTokenIDs {
+		return nil, fmt.Errorf("balance %s is too large to enumerate", balance)
+	}
+	var calls []string
+	for i := int64(0); i < balance.Int64(); i++ {
+		calls = append(calls, selectorTokenOfOwnerByIndex+owner+abiUint(big.NewInt(i)))
+	}
+	results, err = ethCalls(chain.RPCURL, "latest", collection.Contract, calls)
+	if err != nil {
+		return nil, err
+	}
+	var tokenIDs []string
+	for _, result := range results {
+		if result.Err != nil {
+			return nil, fmt.Errorf("collection %q is not enumerable, configure its token ID ranges: %v", collection.Name, result.Err)
+		}
+		tokenIDs = append(tokenIDs, result.Value.String())
+	}
+	return tokenIDs, nil
+}
+
+// checkEnumerableCollections makes sure the rpc checker can list the tokens
+// of ERC-721 collections without token ID ranges, which needs
+// tokenOfOwnerByIndex. Otherwise every claim would fail with
+// nft_check_unavailable. Collections whose chain cannot be reached at
+// startup are logged and left to be checked on request.
+func checkEnumerableCollections(c NFTConfig) error {
+	if c.Checker != "rpc" && c.Fallback != "rpc" {
+		return nil
+	}
+	for _, collection := range c.Collections {
+		if collection.Snapshot != "" || collection.Standard == "erc1155" || len(collection.TokenIDs) > 0 {
+			continue
+		}
+		call := selectorSupportsInterface + interfaceERC721Enumerable + strings.Repeat("0", 56)
+		results, err := ethCalls(c.Chains[collection.Chain].RPCURL, "latest", collection.Contract, []string{call})
+		if err != nil {
+			log.Printf("Could not check whether NFT collection %q is enumerable: %v", collection.Name, err)
+			continue
+		}
+		if results[0].Err != nil || results[0].Value.Sign() == 0 {
+			return fmt.Errorf("NFT collection %q does not support tokenOfOwnerByIndex, so the rpc checker cannot find a holder's tokens; configure its tokenIds ranges", collection.Name)
+		}
+	}
+	return nil
+}
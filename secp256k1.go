@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// Public key recovery on secp256k1, the curve y² = x³ + 7 used by Ethereum
+// signatures. Only verification is done here, so the plain math/big
+// arithmetic does not need to be constant time.
+
+var (
+	secp256k1P, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secp256k1N, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secp256k1Gx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secp256k1Gy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+)
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// ecPoint is an affine point; nil coordinates stand for the point at
+// infinity.
+type ecPoint struct {
+	x, y *big.Int
+}
+
+func (p ecPoint) infinity() bool {
+	return p.x == nil
+}
+
+func ecAdd(a, b ecPoint) ecPoint {
+	if a.infinity() {
+		return b
+	}
+	if b.infinity() {
+		return a
+	}
+	p := secp256k1P
+	var slope *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		sum := new(big.Int).Add(a.y, b.y)
+		if sum.Mod(sum, p).Sign() == 0 {
+			return ecPoint{}
+		}
+		// Doubling: slope = 3x² / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		slope = num.Mul(num, modInverse(den, p))
+	} else {
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		slope = num.Mul(num, modInverse(den, p))
+	}
+	slope.Mod(slope, p)
+	x := new(big.Int).Mul(slope, slope)
+	x.Sub(x, a.x).Sub(x, b.x).Mod(x, p)
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, slope).Sub(y, a.y).Mod(y, p)
+	return ecPoint{x, y}
+}
+
+func modInverse(a, m *big.Int) *big.Int {
+	return new(big.Int).ModInverse(new(big.Int).Mod(a, m), m)
+}
+
+func ecMul(pt ecPoint, k *big.Int) ecPoint {
+	result := ecPoint{}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		result = ecAdd(result, result)
+		if k.Bit(i) == 1 {
+			result = ecAdd(result, pt)
+		}
+	}
+	return result
+}
+
+// ecrecoverAddress returns the address, as lowercase 0x-prefixed hex, of the
+// key that produced the 65-byte r || s || v signature of the 32-byte hash.
+// v may be 0/1 or 27/28.
+func ecrecoverAddress(hash, signature []byte) (string, error) {
+	if len(hash) != 32 || len(signature) != 65 {
+		return "", errInvalidSignature
+	}
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:64])
+	v := signature[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 || r.Sign() == 0 || s.Sign() == 0 || r.Cmp(secp256k1N) >= 0 || s.Cmp(secp256k1N) >= 0 {
+		return "", errInvalidSignature
+	}
+
+	// R is the point with x = r whose y has the parity given by v
+	p := secp256k1P
+	y2 := new(big.Int).Exp(r, big.NewInt(3), p)
+	y2.Add(y2, big.NewInt(7)).Mod(y2, p)
+	y := new(big.Int).ModSqrt(y2, p)
+	if y == nil {
+		return "", errInvalidSignature
+	}
+	if y.Bit(0) != uint(v) {
+		y.Sub(p, y)
+	}
+	R := ecPoint{r, y}
+
+	// Q = r⁻¹ (sR - eG)
+	e := new(big.Int).SetBytes(hash)
+	rInv := new(big.Int).ModInverse(r, secp256k1N)
+	u1 := new(big.Int).Mul(new(big.Int).Neg(e), rInv)
+	u1.Mod(u1, secp256k1N)
+	u2 := new(big.Int).Mul(s, rInv)
+	u2.Mod(u2, secp256k1N)
+	Q := ecAdd(ecMul(ecPoint{secp256k1Gx, secp256k1Gy}, u1), ecMul(R, u2))
+	if Q.infinity() {
+		return "", errInvalidSignature
+	}
+
+	var pub [64]byte
+	Q.x.FillBytes(pub[:32])
+	Q.y.FillBytes(pub[32:])
+	return "0x" + hex.EncodeToString(keccak256(pub[:])[12:]), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMSSender delivers a text message to a phone number in E.164 form.
+type SMSSender interface {
+	Send(to, message string) error
+}
+
+// SMSConfig selects the SMS provider: "http" posts to an SMS gateway, "file"
+// appends messages to a file and "log" writes them to the server log. The
+// last two are meant for development and refused for apps whose codes go by
+// SMS unless Development is set.
+type SMSConfig struct {
+	Provider    string        `json:"provider"`
+	HTTP        HTTPSMSConfig `json:"http"`
+	FilePath    string        `json:"filePath"`
+	Development bool          `json:"development"`
+	// DefaultCountryCode is the calling code, e.g. "1" or "49", of phone
+	// numbers written without one. Without it such numbers get no SMS.
+	DefaultCountryCode string `json:"defaultCountryCode"`
+}
+
+// HTTPSMSConfig describes a JSON SMS gateway. The message is posted as a JSON
+// object with the recipient, text and optional sender under the configured
+// field names, and the token read from TokenFile is sent in AuthHeader.
+type HTTPSMSConfig struct {
+	URL          string `json:"url"`
+	AuthHeader   string `json:"authHeader"`
+	AuthScheme   string `json:"authScheme"`
+	TokenFile    string `json:"tokenFile"`
+	From         string `json:"from"`
+	ToField      string `json:"toField"`
+	MessageField string `json:"messageField"`
+	FromField    string `json:"fromField"`
+}
+
+func defaultSMSConfig() SMSConfig {
+	return SMSConfig{
+		Provider: "log",
+		FilePath: "sms.log",
+		HTTP: HTTPSMSConfig{
+			AuthHeader:   "Authorization",
+			AuthScheme:   "Bearer",
+			TokenFile:    "sms.key",
+			ToField:      "to",
+			MessageField: "message",
+			FromField:    "from",
+		},
+	}
+}
+
+var smsSender SMSSender = logSMSSender{}
+
+// validateSMSConfig refuses the development providers when codes for an app
+// go by SMS, as they would never reach the user.
+func validateSMSConfig(c SMSConfig, otp OTPConfig) error {
+	for app, channel := range otp.Apps {
+		if channel == "sms" && (c.Provider == "" || c.Provider == "log" || c.Provider == "file") && !c.Development {
+			return fmt.Errorf("app %s sends codes by SMS but the SMS provider is %q; configure the http provider or set sms.development", app, c.Provider)
+		}
+	}
+	for _, r := range c.DefaultCountryCode {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("sms.defaultCountryCode must be digits such as \"1\", not %q", c.DefaultCountryCode)
+		}
+	}
+	return nil
+}
+
+func newSMSSender(c SMSConfig) (SMSSender, error) {
+	switch c.Provider {
+	case "", "log":
+		return logSMSSender{}, nil
+	case "file":
+		return &fileSMSSender{path: c.FilePath}, nil
+	case "http":
+		if c.HTTP.URL == "" {
+			return nil, fmt.Errorf("sms.http.url is required for the http SMS provider")
+		}
+		token, err := readAPIKey(c.HTTP.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &httpSMSSender{config: c.HTTP, token: strings.TrimSpace(token), client: &http.Client{Timeout: 15 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", c.Provider)
+	}
+}
+
+type httpSMSSender struct {
+	config HTTPSMSConfig
+	token  string
+	client *http.Client
+}
+
+func (s *httpSMSSender) Send(to, message string) error {
+	payload := map[string]string{
+		s.config.ToField:      to,
+		s.config.MessageField: message,
+	}
+	if s.config.From != "" {
+		payload[s.config.FromField] = s.config.From
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := doWithBackoff(s.client, defaultBackoff, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", s.config.URL, bytes.NewReader(payloadBytes))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("accept", "application/json")
+		if s.token != "" {
+			value := s.token
+			if s.config.AuthScheme != "" {
+				value = s.config.AuthScheme + " " + s.token
+			}
+			req.Header.Set(s.config.AuthHeader, value)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return statusError(resp, body)
+	}
+	return nil
+}
+
+// fileSMSSender appends every message to a file instead of sending it.
+type fileSMSSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileSMSSender) Send(to, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s, %s, %s\n", time.Now().Format(time.RFC3339), to, message)
+	return err
+}
+
+// logSMSSender writes messages to the server log instead of sending them.
+type logSMSSender struct{}
+
+func (logSMSSender) Send(to, message string) error {
+	log.Printf("SMS to %s: %s", to, message)
+	return nil
+}
+
+// sendOTPSMS sends a one-time verification code with the configured sender
+func sendOTPSMS(phoneNumber, code, lang string, ttl time.Duration) error {
+	message := fmt.Sprintf("Your Functionyard verification code is %s. It expires in %d minutes.", code, int(ttl.Minutes()))
+	return smsSender.Send(phoneNumber, message)
+}
+
+// smsDestination returns the phone number on an order in E.164 form. The
+// number must carry its country code ("+" or "00") unless a default country
+// code is configured, in which case a national number has its trunk "0"
+// removed and the code put in front. Numbers masked in the export, without a
+// country code or of the wrong length yield "", so no code is texted to a
+// number in the wrong country.
+func smsDestination(order *OrderRecord) string {
+	phone := strings.TrimSpace(order.ShippingPhone)
+	if strings.ContainsAny(phone, "*xX") {
+		return ""
+	}
+	var digits strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	number := digits.String()
+	switch {
+	case strings.HasPrefix(phone, "+"):
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case cfg.SMS.DefaultCountryCode != "":
+		number = cfg.SMS.DefaultCountryCode + strings.TrimPrefix(number, "0")
+	default:
+		return ""
+	}
+	// E.164 numbers have at most 15 digits; 8 is the shortest dialable one
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return ""
+	}
+	return "+" + number
+}
+
+// maskPhone shows only the last four digits, e.g. "***1234".
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return "***"
+	}
+	return "***" + phone[len(phone)-4:]
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSMSDestination(t *testing.T) {
+	cfg = defaultConfig()
+	defer func() { cfg = defaultConfig() }()
+	tests := []struct {
+		phone, countryCode, want string
+	}{
+		{"+1 (555) 123-4567", "", "+15551234567"},
+		{"+49 30 1234567", "", "+49301234567"},
+		{"0049 30 1234567", "", "+49301234567"},
+		{"0612345678", "", ""},
+		{"5551234567", "", ""},
+		{"0612345678", "31", "+31612345678"},
+		{"555 123 4567", "1", "+15551234567"},
+		{"+1 555 ***4567", "", ""},
+		{"+1 555", "", ""},
+		{"+1234567890123456", "", ""},
+		{"", "1", ""},
+	}
+	for _, tt := range tests {
+		cfg.SMS.DefaultCountryCode = tt.countryCode
+		if got := smsDestination(&OrderRecord{ShippingPhone: tt.phone}); got != tt.want {
+			t.Errorf("smsDestination(%q) with country code %q = %q; want %q", tt.phone, tt.countryCode, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSMSConfig(t *testing.T) {
+	otp := OTPConfig{Apps: map[string]string{"land.fx.blox": "sms"}}
+	if err := validateSMSConfig(defaultSMSConfig(), otp); err == nil {
+		t.Error("log provider accepted for an SMS app")
+	}
+	dev := defaultSMSConfig()
+	dev.Development = true
+	if err := validateSMSConfig(dev, otp); err != nil {
+		t.Errorf("development setup refused: %v", err)
+	}
+	if err := validateSMSConfig(defaultSMSConfig(), OTPConfig{Apps: map[string]string{"main": "email"}}); err != nil {
+		t.Errorf("log provider refused without SMS apps: %v", err)
+	}
+	bad := SMSConfig{Provider: "http", DefaultCountryCode: "+1"}
+	if err := validateSMSConfig(bad, otp); err == nil {
+		t.Error("country code with a plus accepted")
+	}
+}
+
+func TestRequirePossessionNoEmailFallback(t *testing.T) {
+	cfg = defaultConfig()
+	defer func() { cfg = defaultConfig() }()
+	cfg.OTP.Apps = map[string]string{"land.fx.blox": "sms"}
+	order := &OrderRecord{OrderNo: "1001", Email: "jane@example.com", ShippingPhone: "***4567"}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/register", nil)
+	if requirePossession(w, r, "land.fx.blox", order, "acc") {
+		t.Fatal("request went on without a code")
+	}
+	var response map[string]string
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusBadRequest || response["code"] != "otp_no_destination" {
+		t.Errorf("answered %d %v", w.Code, response)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HolderSnapshot freezes the holders of a collection at a block, so claims
+// during a launch event are checked against it instead of live ownership.
+type HolderSnapshot struct {
+	Chain       string           `json:"chain"`
+	Contract    string           `json:"contract"`
+	BlockNumber uint64           `json:"blockNumber"`
+	BlockTime   time.Time        `json:"blockTime"`
+	Holders     []SnapshotHolder `json:"holders"`
+}
+
+type SnapshotHolder struct {
+	Address  string   `json:"address"`
+	TokenIDs []string `json:"tokenIds"`
+}
+
+// Selectors used to enumerate the tokens of an ERC-721 collection.
+const (
+	selectorTotalSupply  = "18160ddd" // totalSupply()
+	selectorTokenByIndex = "4f6ccce7" // tokenByIndex(uint256)
+)
+
+// maxSnapshotTokens bounds the tokens read when building a snapshot.
+const maxSnapshotTokens = 100000
+
+var (
+	holderSnapshotsMu sync.RWMutex
+	// holderSnapshots maps a snapshot file to the token IDs held per
+	// lowercase address.
+	holderSnapshots = make(map[string]map[string][]string)
+)
+
+// loadHolderSnapshots reads the snapshot files of the configured collections.
+func loadHolderSnapshots(c NFTConfig) error {
+	loaded := make(map[string]map[string][]string)
+	for _, collection := range c.Collections {
+		if collection.Snapshot == "" {
+			continue
+		}
+		data, err := os.ReadFile(collection.Snapshot)
+		if err != nil {
+			return err
+		}
+		var snapshot HolderSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("error parsing %s: %v", collection.Snapshot, err)
+		}
+		if !strings.EqualFold(snapshot.Chain, collection.Chain) || !strings.EqualFold(snapshot.Contract, collection.Contract) {
+			return fmt.Errorf("snapshot %s is for %s %s, not for collection %q", collection.Snapshot, snapshot.Chain, snapshot.Contract, collection.Name)
+		}
+		holders := make(map[string][]string)
+		for _, holder := range snapshot.Holders {
+			address := strings.ToLower(holder.Address)
+			holders[address] = append(holders[address], holder.TokenIDs...)
+		}
+		loaded[collection.Snapshot] = holders
+		log.Printf("Loaded snapshot of %d %s holders at block %d", len(holders), collection.Name, snapshot.BlockNumber)
+	}
+	holderSnapshotsMu.Lock()
+	holderSnapshots = loaded
+	holderSnapshotsMu.Unlock()
+	return nil
+}
+
+// snapshotTokenIDs lists the eligible token IDs the address held when the
+// collection's snapshot was taken.
+func snapshotTokenIDs(collection NFTCollection, address string) ([]string, error) {
+	holderSnapshotsMu.RLock()
+	holders, ok := holderSnapshots[collection.Snapshot]
+	holderSnapshotsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s is not loaded", collection.Snapshot)
+	}
+	var tokenIDs []string
+	for _, tokenID := range holders[strings.ToLower(address)] {
+		if collection.eligibleTokenID(tokenID) {
+			tokenIDs = append(tokenIDs, tokenID)
+		}
+	}
+	return tokenIDs, nil
+}
+
+// runSnapshotCommand builds a holder snapshot of a configured collection from
+// its chain's JSON-RPC endpoint:
+//
+//	testnet-server snapshot -collection "Functional Elephants Club" -at 2024-06-01T00:00:00Z -out fec.json
+func runSnapshotCommand(args []string) {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "Path to the optional JSON config file")
+	name := flags.String("collection", "", "Name of the configured collection")
+	block := flags.Uint64("block", 0, "Block number to take the snapshot at (default latest)")
+	at := flags.String("at", "", "Take the snapshot at the last block before this RFC 3339 time")
+	out := flags.String("out", "snapshot.json", "File to write the snapshot to")
+	flags.Parse(args)
+
+	var err error
+	cfg, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	var collection *NFTCollection
+	for i := range cfg.NFT.Collections {
+		if cfg.NFT.Collections[i].Name == *name {
+			collection = &cfg.NFT.Collections[i]
+		}
+	}
+	if collection == nil {
+		log.Fatalf("No NFT collection named %q is configured", *name)
+	}
+	rpcURL := cfg.NFT.Chains[collection.Chain].RPCURL
+	if rpcURL == "" {
+		log.Fatalf("No JSON-RPC endpoint configured for chain %q", collection.Chain)
+	}
+
+	blockNumber := *block
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			log.Fatalf("Invalid time %q: %v", *at, err)
+		}
+		if blockNumber, err = blockBefore(rpcURL, t); err != nil {
+			log.Fatalf("Error finding the block at %s: %v", *at, err)
+		}
+	} else if blockNumber == 0 {
+		var latest string
+		if err := rpcCall(rpcURL, "eth_blockNumber", []any{}, &latest); err != nil {
+			log.Fatalf("Error reading the latest block: %v", err)
+		}
+		if blockNumber, err = strconv.ParseUint(strings.TrimPrefix(latest, "0x"), 16, 64); err != nil {
+			log.Fatalf("Invalid block number %q: %v", latest, err)
+		}
+	}
+
+	snapshot, err := buildHolderSnapshot(*collection, rpcURL, blockNumber)
+	if err != nil {
+		log.Fatalf("Error building snapshot: %v", err)
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		log.Fatalf("Error marshaling snapshot: %v", err)
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		log.Fatalf("Error writing snapshot: %v", err)
+	}
+	log.Printf("Wrote %d holders of %s at block %d to %s", len(snapshot.Holders), collection.Name, snapshot.BlockNumber, *out)
+}
+
+// blockTime returns the timestamp of a block.
+func blockTime(rpcURL string, number uint64) (time.Time, error) {
+	var block struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if err := rpcCall(rpcURL, "eth_getBlockByNumber", []any{fmt.Sprintf("0x%x", number), false}, &block); err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(strings.TrimPrefix(block.Timestamp, "0x"), 16, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp of block %d: %q", number, block.Timestamp)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// blockBefore finds the last block mined at or before t by binary search.
+func blockBefore(rpcURL string, t time.Time) (uint64, error) {
+	var latest string
+	if err := rpcCall(rpcURL, "eth_blockNumber", []any{}, &latest); err != nil {
+		return 0, err
+	}
+	hi, err := strconv.ParseUint(strings.TrimPrefix(latest, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block number %q", latest)
+	}
+	lo := uint64(0)
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		midTime, err := blockTime(rpcURL, mid)
+		if err != nil {
+			return 0, err
+		}
+		if midTime.After(t) {
+			hi = mid - 1
+		} else {
+			lo = mid
+		}
+	}
+	return lo, nil
+}
+
+// buildHolderSnapshot reads the owner of every token at the block. Tokens are
+// those in the collection's token ID ranges or, without ranges, enumerated
+// with totalSupply and tokenByIndex. ERC-1155 holders cannot be enumerated
+// through contract calls.
+func buildHolderSnapshot(collection NFTCollection, rpcURL string, blockNumber uint64) (HolderSnapshot, error) {
+	if collection.Standard == "erc1155" {
+		return HolderSnapshot{}, fmt.Errorf("holders of ERC-1155 collections cannot be enumerated on chain")
+	}
+	block := fmt.Sprintf("0x%x", blockNumber)
+	ids := collection.rangeTokenIDs(maxSnapshotTokens)
+	if len(ids) > maxSnapshotTokens {
+		return HolderSnapshot{}, fmt.Errorf("token ID ranges cover more than %d IDs", maxSnapshotTokens)
+	}
+	if len(ids) == 0 {
+		results, err := ethCalls(rpcURL, block, collection.Contract, []string{selectorTotalSupply})
+		if err != nil {
+			return HolderSnapshot{}, err
+		}
+		if results[0].Err != nil {
+			return HolderSnapshot{}, fmt.Errorf("collection is not enumerable, configure its token ID ranges: %v", results[0].Err)
+		}
+		supply := results[0].Value
+		if !supply.IsInt64() || supply.Int64() > maxSnapshotTokens {
+			return HolderSnapshot{}, fmt.Errorf("total supply %s is too large", supply)
+		}
+		var calls []string
+		for i := int64(0); i < supply.Int64(); i++ {
+			calls = append(calls, selectorTokenByIndex+abiUint(big.NewInt(i)))
+		}
+		results, err = ethCalls(rpcURL, block, collection.Contract, calls)
+		if err != nil {
+			return HolderSnapshot{}, err
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				return HolderSnapshot{}, fmt.Errorf("collection is not enumerable, configure its token ID ranges: %v", result.Err)
+			}
+			ids = append(ids, result.Value)
+		}
+	}
+
+	var calls []string
+	for _, id := range ids {
+		calls = append(calls, selectorOwnerOf+abiUint(id))
+	}
+	results, err := ethCalls(rpcURL, block, collection.Contract, calls)
+	if err != nil {
+		return HolderSnapshot{}, err
+	}
+	tokens := make(map[string][]string)
+	for i, result := range results {
+		// Tokens not minted yet at the block, or burned, have no owner
+		if result.Err != nil || result.Value.Sign() == 0 {
+			continue
+		}
+		owner := fmt.Sprintf("0x%040x", result.Value)
+		tokens[owner] = append(tokens[owner], ids[i].String())
+	}
+
+	snapshot := HolderSnapshot{Chain: collection.Chain, Contract: collection.Contract, BlockNumber: blockNumber, Holders: []SnapshotHolder{}}
+	if snapshot.BlockTime, err = blockTime(rpcURL, blockNumber); err != nil {
+		return HolderSnapshot{}, err
+	}
+	for address, tokenIDs := range tokens {
+		snapshot.Holders = append(snapshot.Holders, SnapshotHolder{Address: address, TokenIDs: tokenIDs})
+	}
+	sort.Slice(snapshot.Holders, func(i, j int) bool { return snapshot.Holders[i].Address < snapshot.Holders[j].Address })
+	return snapshot, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHolderSnapshots(t *testing.T) {
+	t.Cleanup(func() { loadHolderSnapshots(NFTConfig{}) })
+	path := filepath.Join(t.TempDir(), "fec.json")
+	snapshot := `{"chain": "matic", "contract": "0xE44D2CE514FD50FFA3A296EE6CE01BB1DDB5B6D6", "blockNumber": 100,
+		"holders": [
+			{"address": "0xAbC0000000000000000000000000000000000001", "tokenIds": ["7", "500"]},
+			{"address": "0xabc0000000000000000000000000000000000001", "tokenIds": ["9"]}
+		]}`
+	if err := os.WriteFile(path, []byte(snapshot), 0644); err != nil {
+		t.Fatal(err)
+	}
+	collection := NFTCollection{Name: "FEC", Chain: "matic", Contract: "0xe44d2ce514fd50ffa3a296ee6ce01bb1ddb5b6d6", Snapshot: path, TokenIDs: []TokenIDRange{{From: "1", To: "100"}}}
+	if err := loadHolderSnapshots(NFTConfig{Collections: []NFTCollection{collection}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, address, want string
+	}{
+		{"holder in other case, entries merged", "0xABC0000000000000000000000000000000000001", "7,9"},
+		{"not a holder", "0xabc0000000000000000000000000000000000002", ""},
+	}
+	for _, tt := range tests {
+		tokenIDs, err := snapshotTokenIDs(collection, tt.address)
+		if err != nil || strings.Join(tokenIDs, ",") != tt.want {
+			t.Errorf("%s: snapshotTokenIDs = %v, %v; want %s", tt.name, tokenIDs, err, tt.want)
+		}
+	}
+	// Token ranges narrowed after the snapshot was taken still apply
+	narrowed := collection
+	narrowed.TokenIDs = []TokenIDRange{{From: "9", To: "9"}}
+	if tokenIDs, _ := snapshotTokenIDs(narrowed, "0xabc0000000000000000000000000000000000001"); strings.Join(tokenIDs, ",") != "9" {
+		t.Errorf("narrowed ranges: %v", tokenIDs)
+	}
+	unloaded := collection
+	unloaded.Snapshot = "other.json"
+	if _, err := snapshotTokenIDs(unloaded, "0xabc0000000000000000000000000000000000001"); err == nil {
+		t.Error("unloaded snapshot answered")
+	}
+
+	mismatches := map[string]func(*NFTCollection){
+		"other chain":    func(c *NFTCollection) { c.Chain = "ethereum" },
+		"other contract": func(c *NFTCollection) { c.Contract = "0x0000000000000000000000000000000000000001" },
+		"missing file":   func(c *NFTCollection) { c.Snapshot = filepath.Join(filepath.Dir(path), "missing.json") },
+	}
+	for name, change := range mismatches {
+		c := collection
+		change(&c)
+		if err := loadHolderSnapshots(NFTConfig{Collections: []NFTCollection{c}}); err == nil {
+			t.Errorf("%s: snapshot loaded", name)
+		}
+	}
+	// A failed load keeps the snapshots loaded before
+	if tokenIDs, err := snapshotTokenIDs(collection, "0xabc0000000000000000000000000000000000001"); err != nil || len(tokenIDs) != 2 {
+		t.Errorf("after failed loads: %v, %v", tokenIDs, err)
+	}
+}
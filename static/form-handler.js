@@ -8,6 +8,8 @@ document.addEventListener("DOMContentLoaded", function() {
     let bloxOptions = document.getElementById('bloxOptions');
     let bloxJoinType = document.getElementById('bloxJoinType');
     let verifyNFTButton = document.getElementById('verifyNFT');
+    let otpGroup = document.getElementById('otpGroup');
+    let resendCodeButton = document.getElementById('resendCode');
 
 
     function setVisibleFields() {
@@ -144,7 +146,19 @@ document.addEventListener("DOMContentLoaded", function() {
             if (data.status === 'success') {
                 successMessage.innerText = data.message;
                 successMessage.style.display = 'block';
+                otpGroup.style.display = 'none';
+            } else if (data.status === 'otp_required') {
+                // A one-time code was sent, ask for it and submit again
+                form.challengeId.value = data.challengeId;
+                form.otpCode.value = '';
+                otpGroup.style.display = 'block';
+                successMessage.innerText = data.message;
+                successMessage.style.display = 'block';
+                submitButton.disabled = false;
             } else {
+                if (data.challengeId) {
+                    form.challengeId.value = data.challengeId;
+                }
                 errorMessage.innerText = data.message;
                 errorMessage.style.display = 'block';
                 submitButton.disabled = false; // Re-enable the button on error
@@ -159,6 +173,11 @@ document.addEventListener("DOMContentLoaded", function() {
         });
     });
 
+    resendCodeButton.addEventListener('click', function() {
+        form.otpCode.value = '';
+        form.requestSubmit();
+    });
+
     verifyNFTButton.addEventListener('click', async function() {
         if (typeof window.ethereum !== 'undefined') {
             try {
@@ -167,6 +186,26 @@ document.addEventListener("DOMContentLoaded", function() {
                 const address = accounts[0];
                 const tokenAccountId = document.getElementById('tokenAccountId').value;
                 const appId = document.getElementById('appId').value;
+
+                // Sign the server's challenge to prove the wallet is ours
+                const challengeResponse = await fetch('/nft-challenge', {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json',
+                    },
+                    body: JSON.stringify({
+                        address: address,
+                        tokenAccountId: tokenAccountId
+                    }),
+                });
+                const challenge = await challengeResponse.json();
+                if (challenge.status !== 'success') {
+                    throw new Error(challenge.message);
+                }
+                const signature = await window.ethereum.request({
+                    method: 'personal_sign',
+                    params: [challenge.message, address],
+                });
     
                 // Verify NFT ownership and fund account
                 const response = await fetch('/verify-nft-and-fund', {
@@ -177,7 +216,10 @@ document.addEventListener("DOMContentLoaded", function() {
                     body: JSON.stringify({ 
                         address: address,
                         tokenAccountId: tokenAccountId,
-                        appId: appId
+                        appId: appId,
+                        email: form.email.value,
+                        nonce: challenge.nonce,
+                        signature: signature
                     }),
                 });
     
@@ -1,13 +1,13 @@
 document.addEventListener("DOMContentLoaded", function() {
-    let streamrForm = document.getElementById('streamrForm');
-    let submitButton = streamrForm.querySelector('button[type="submit"]');
+    let programForm = document.getElementById('programForm');
+    let submitButton = programForm.querySelector('button[type="submit"]');
     let successMessage = document.getElementById('successMessage');
     let errorMessage = document.getElementById('errorMessage');
     let verifyingMessage = document.getElementById('verifyingMessage');
 
     
-    if (streamrForm) {
-        streamrForm.addEventListener('submit', function(event) {
+    if (programForm) {
+        programForm.addEventListener('submit', function(event) {
             event.preventDefault();
 
             // Clear existing messages
@@ -15,14 +15,14 @@ document.addEventListener("DOMContentLoaded", function() {
             errorMessage.style.display = 'none';
 
             // Show verifying message
-            verifyingMessage.innerText = "Processing your Streamr node request...";
+            verifyingMessage.innerText = "Processing your " + programForm.dataset.title + " request...";
             verifyingMessage.style.display = 'block';
 
             // Disable the button
             submitButton.disabled = true;
 
-            let formData = new FormData(streamrForm);
-            fetch('/streamr', {
+            let formData = new FormData(programForm);
+            fetch(programForm.action, {
                 method: 'POST',
                 body: formData
             })
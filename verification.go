@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VerificationReason is a stable code describing the outcome of an order
+// verification. The values are persisted and shown to support staff, so they
+// must not be renamed.
+type VerificationReason string
+
+const (
+	ReasonMatched       VerificationReason = "matched"
+	ReasonInvalidPhone  VerificationReason = "invalid_phone"
+	ReasonEmailNotFound VerificationReason = "email_not_found"
+	ReasonOrderMismatch VerificationReason = "order_mismatch"
+	ReasonPhoneMismatch VerificationReason = "phone_mismatch"
+	ReasonOrderRefunded VerificationReason = "order_refunded"
+	ReasonAmountTooLow  VerificationReason = "amount_too_low"
+)
+
+// reasonRank orders the failure reasons by how close the submission came to a
+// full match, so the most specific reason is reported when an email has
+// several orders.
+var reasonRank = map[VerificationReason]int{
+	ReasonInvalidPhone:  0,
+	ReasonEmailNotFound: 1,
+	ReasonOrderMismatch: 2,
+	ReasonPhoneMismatch: 3,
+	ReasonOrderRefunded: 4,
+	ReasonAmountTooLow:  5,
+	ReasonMatched:       6,
+}
+
+// VerificationResult is the full outcome of verifyOrder. Order is the record
+// that matched or, on failure, the closest record found for the email.
+type VerificationResult struct {
+	Matched      bool               `json:"matched"`
+	EmailMatched bool               `json:"emailMatched"`
+	Reason       VerificationReason `json:"reason"`
+	Source       string             `json:"source"`
+	Order        *OrderRecord       `json:"order,omitempty"`
+}
+
+// publicReason is the subset of a verification result that is safe to show
+// to the person submitting the form.
+type publicReason struct {
+	Code    string
+	Message string
+}
+
+const orderNotMatchedMessage = "Your order could not be found automatically or does not match what we have in our system. If your email is in the system you will shortly receive an email with registered order details. You can also contact testnet@fx.land"
+
+// Public returns the code and message shown to the user. Reasons that would
+// reveal whether an email or order exists are collapsed into a single code;
+// the specific reasons are only given once email, order and phone all match.
+func (v VerificationResult) Public() publicReason {
+	switch v.Reason {
+	case ReasonMatched:
+		return publicReason{"matched", "Order verified"}
+	case ReasonInvalidPhone:
+		return publicReason{"invalid_phone", "Please enter at least the last 4 digits of your phone number."}
+	case ReasonOrderRefunded:
+		return publicReason{"order_refunded", "This order has been refunded and cannot be used to join. You can contact testnet@fx.land"}
+	case ReasonAmountTooLow:
+		return publicReason{"amount_too_low", "The amount of this order is not eligible to join. You can contact testnet@fx.land"}
+	default:
+		return publicReason{"order_not_matched", orderNotMatchedMessage}
+	}
+}
+
+// VerificationRecord is a logged verification attempt, kept for support.
+type VerificationRecord struct {
+	Reference   string             `json:"reference"`
+	Time        time.Time          `json:"time"`
+	Source      string             `json:"source"`
+	Email       string             `json:"email"`
+	OrderID     string             `json:"orderId"`
+	PhoneLast4  string             `json:"phoneLast4"`
+	RemoteAddr  string             `json:"remoteAddr"`
+	Result      VerificationResult `json:"result"`
+	EmailedUser bool               `json:"emailedUser"`
+}
+
+const verificationLogFile = "verifications.jsonl"
+
+var verificationLogMu sync.Mutex
+
+func newReference() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// recordVerification logs a verification attempt and appends it to the
+// verification log. It returns the reference given to the user.
+func recordVerification(r *http.Request, source, email, orderID, phoneNumber string, result VerificationResult, emailedUser bool) string {
+	phone := sanitizeInput(phoneNumber)
+	if len(phone) > 4 {
+		phone = phone[len(phone)-4:]
+	}
+	record := VerificationRecord{
+		Reference:   newReference(),
+		Time:        time.Now(),
+		Source:      source,
+		Email:       sanitizeInput(email),
+		OrderID:     sanitizeInput(orderID),
+		PhoneLast4:  phone,
+		RemoteAddr:  clientIP(r),
+		Result:      result,
+		EmailedUser: emailedUser,
+	}
+	log.Printf("Order verification %s from %s: matched=%t emailMatched=%t reason=%s", record.Reference, source, result.Matched, result.EmailMatched, result.Reason)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Error marshaling verification record:", err)
+		return record.Reference
+	}
+
+	verificationLogMu.Lock()
+	defer verificationLogMu.Unlock()
+	file, err := os.OpenFile(verificationLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Error opening verification log:", err)
+		return record.Reference
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Println("Error writing verification log:", err)
+	}
+	return record.Reference
+}
+
+// adminVerificationsHandler returns the logged verification attempts matching
+// the reference, email or orderId query parameters.
+func adminVerificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reference := r.URL.Query().Get("reference")
+	email := r.URL.Query().Get("email")
+	orderID := sanitizeInput(r.URL.Query().Get("orderId"))
+	if reference == "" && email == "" && orderID == "" {
+		http.Error(w, "One of reference, email or orderId is required", http.StatusBadRequest)
+		return
+	}
+
+	verificationLogMu.Lock()
+	defer verificationLogMu.Unlock()
+	file, err := os.Open(verificationLogFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Error opening verification log:", err)
+		http.Error(w, "Error reading verification log", http.StatusInternalServerError)
+		return
+	}
+
+	records := []VerificationRecord{}
+	if file != nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record VerificationRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			if reference != "" && record.Reference != reference {
+				continue
+			}
+			if email != "" && !sameMailbox(record.Email, email) {
+				continue
+			}
+			if orderID != "" && !strings.EqualFold(record.OrderID, orderID) {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// respondVerificationFailure records a failed verification, answers with the
+// public reason and, when the email is known, mails the registered order
+// details to the address on file.
+func respondVerificationFailure(w http.ResponseWriter, r *http.Request, source, email, orderID, phoneNumber string, result VerificationResult) {
+	emailed := false
+	if result.EmailMatched && result.Order != nil {
+		err := sendEmailDetails(result.Order.Email, requestLanguage(r), result.Order.OrderNo, result.Order.ShippingPhone, result.Order.Amount)
+		log.Println("Email sending result")
+		log.Println(err)
+		emailed = err == nil
+	}
+	reference := recordVerification(r, source, email, orderID, phoneNumber, result, emailed)
+
+	public := result.Public()
+	writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": public.Code, "message": public.Message, "reference": reference})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WalletAuthConfig controls the signed challenge that proves control of the
+// wallet used for NFT-gated funding. The client asks /nft-challenge for a
+// Sign-In-With-Ethereum style message, signs it with personal_sign (EIP-191)
+// and sends the nonce and signature along with the NFT request.
+type WalletAuthConfig struct {
+	// Required rejects NFT requests without a valid signature. Turning it
+	// off lets old clients keep working during a rollout.
+	Required bool `json:"required"`
+	// Domain and URI are shown in the message. Domain is required, since the
+	// Host header is chosen by the client; URI defaults to https://<domain>.
+	Domain   string   `json:"domain"`
+	URI      string   `json:"uri"`
+	ChainID  int      `json:"chainId"`
+	NonceTTL Duration `json:"nonceTTL"`
+	// DelegationTTL is how long a delegation signed by a vault lasts.
+	DelegationTTL Duration `json:"delegationTTL"`
+}
+
+func defaultWalletAuthConfig() WalletAuthConfig {
+	return WalletAuthConfig{
+		Required:      true,
+		ChainID:       137,
+		NonceTTL:      Duration(10 * time.Minute),
+		DelegationTTL: Duration(30 * 24 * time.Hour),
+	}
+}
+
+// validateWalletAuthConfig requires the domain while NFT funding is enabled,
+// that is while any collection is configured.
+func validateWalletAuthConfig(c WalletAuthConfig, nft NFTConfig) error {
+	if c.Domain == "" {
+		if len(nft.Collections) == 0 {
+			return nil
+		}
+		return errors.New("walletAuth.domain must be set, such as \"fx.land\", while nft.collections is not empty")
+	}
+	if strings.ContainsAny(c.Domain, "/ \t\r\n") {
+		return fmt.Errorf("walletAuth.domain must be a host such as \"fx.land\", not %q", c.Domain)
+	}
+	return nil
+}
+
+type walletChallenge struct {
+	nonce          string
+	address        string
+	tokenAccountID string
+	message        string
+	expires        time.Time
+}
+
+// walletChallengeStore keeps issued challenges in memory by nonce. A
+// challenge can be used for one funding request.
+type walletChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]*walletChallenge
+}
+
+var walletChallenges = &walletChallengeStore{challenges: make(map[string]*walletChallenge)}
+
+var (
+	errWalletNonceNotFound = errors.New("unknown or expired nonce")
+	errWalletNonceMismatch = errors.New("nonce was issued for another address or account")
+)
+
+func (s *walletChallengeStore) issue(domain, address, tokenAccountID string) *walletChallenge {
+	now := time.Now().UTC()
+	challenge := &walletChallenge{
+		nonce:          newReference(),
+		address:        strings.ToLower(address),
+		tokenAccountID: tokenAccountID,
+		expires:        now.Add(time.Duration(cfg.WalletAuth.NonceTTL)),
+	}
+	challenge.message = siweMessage(domain, address, tokenAccountID, challenge.nonce, now, challenge.expires)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nonce, c := range s.challenges {
+		if now.After(c.expires) {
+			delete(s.challenges, nonce)
+		}
+	}
+	s.challenges[challenge.nonce] = challenge
+	return challenge
+}
+
+// take returns the challenge for the nonce if it matches the address and
+// account, removing it when consume is set.
+func (s *walletChallengeStore) take(nonce, address, tokenAccountID string, consume bool) (*walletChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge := s.challenges[nonce]
+	if challenge == nil || time.Now().After(challenge.expires) {
+		return nil, errWalletNonceNotFound
+	}
+	if challenge.address != strings.ToLower(address) || challenge.tokenAccountID != tokenAccountID {
+		return nil, errWalletNonceMismatch
+	}
+	if consume {
+		delete(s.challenges, nonce)
+	}
+	return challenge, nil
+}
+
+// siweMessage builds an EIP-4361 message binding the nonce to the account
+// being funded.
+func siweMessage(domain, address, tokenAccountID, nonce string, issued, expires time.Time) string {
+	return fmt.Sprintf("%s wants you to sign in with your Ethereum account:\n%s\n\n"+
+		"Sign in to fund the Functionyard account %s with your NFT.\n\n"+
+		"URI: %s\nVersion: 1\nChain ID: %d\nNonce: %s\nIssued At: %s\nExpiration Time: %s\n"+
+		"Resources:\n- fula:account:%s",
+		domain, checksumAddress(address), tokenAccountID, walletAuthURI(), cfg.WalletAuth.ChainID, nonce,
+		issued.Format(time.RFC3339), expires.Format(time.RFC3339), tokenAccountID)
+}
+
+func walletAuthURI() string {
+	if cfg.WalletAuth.URI != "" {
+		return cfg.WalletAuth.URI
+	}
+	return "https://" + cfg.WalletAuth.Domain
+}
+
+// personalSignHash is the EIP-191 hash signed by personal_sign.
+func personalSignHash(message string) []byte {
+	return keccak256([]byte("\x19Ethereum Signed Message:\n" + strconv.Itoa(len(message)) + message))
+}
+
+// validAddress reports whether s is a 0x-prefixed 20-byte hex address.
+func validAddress(s string) bool {
+	if len(s) != 42 || !strings.HasPrefix(s, "0x") {
+		return false
+	}
+	_, err := hex.DecodeString(s[2:])
+	return err == nil
+}
+
+// normalizeAddress returns the EIP-55 form of an address. Addresses in a
+// single case are accepted as is; mixed-case ones must carry a valid
+// checksum.
+func normalizeAddress(address string) (string, bool) {
+	if !validAddress(address) {
+		return "", false
+	}
+	checksummed := checksumAddress(address)
+	digits := address[2:]
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && address != checksummed {
+		return "", false
+	}
+	return checksummed, true
+}
+
+// checksumAddress returns the EIP-55 mixed-case form of an address.
+func checksumAddress(address string) string {
+	lower := strings.ToLower(strings.TrimPrefix(address, "0x"))
+	hash := hex.EncodeToString(keccak256([]byte(lower)))
+	out := []byte(lower)
+	for i, c := range out {
+		if c >= 'a' && c <= 'f' && hash[i] >= '8' {
+			out[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(out)
+}
+
+// nftChallengeHandler issues the message to sign for an address and account.
+func nftChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	var data struct {
+		Address        string `json:"address"`
+		TokenAccountID string `json:"tokenAccountId"`
+		// Vault is set when the address claims as a delegate of another wallet
+		Vault string `json:"vault"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !validAddress(data.Address) || (data.Vault != "" && !validAddress(data.Vault)) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": "invalid_address", "message": "The wallet address is not valid."})
+		return
+	}
+	if !requireRateLimit(w, ipKey(r)) {
+		return
+	}
+	challenge := walletChallenges.issue(cfg.WalletAuth.Domain, data.Address, data.TokenAccountID)
+	response := map[string]string{
+		"status":    "success",
+		"nonce":     challenge.nonce,
+		"message":   challenge.message,
+		"expiresAt": challenge.expires.Format(time.RFC3339),
+	}
+	if data.Vault != "" && !delegations.has(data.Vault, data.Address) {
+		// Signed by the vault unless the delegate registry covers it
+		delegation := delegations.offer(data.Vault, data.Address)
+		response["delegationMessage"] = delegation.message()
+		response["delegationExpiresAt"] = delegation.Expires.Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// requireWalletSignature checks that the signature over the challenge issued
+// for nonce was made by address. It returns true when the request may go on;
+// otherwise the response has been written. consume uses up the nonce.
+func requireWalletSignature(w http.ResponseWriter, address, tokenAccountID, nonce, signature string, consume bool) bool {
+	if nonce == "" || signature == "" {
+		if !cfg.WalletAuth.Required {
+			return true
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "signature_required", "message": "Please sign the verification message with your wallet."})
+		return false
+	}
+	challenge, err := walletChallenges.take(nonce, address, tokenAccountID, false)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "nonce_invalid", "message": "The verification message has expired or does not match. Please sign a new one."})
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "signature_invalid", "message": "The wallet signature is not valid."})
+		return false
+	}
+	signer, err := ecrecoverAddress(personalSignHash(challenge.message), sig)
+	if err != nil || signer != challenge.address {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "signature_invalid", "message": "The wallet signature is not valid."})
+		return false
+	}
+	if consume {
+		// Another request may have used the nonce in the meantime
+		if _, err := walletChallenges.take(nonce, address, tokenAccountID, true); err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "error", "code": "nonce_invalid", "message": "The verification message has expired or does not match. Please sign a new one."})
+			return false
+		}
+	}
+	return true
+}
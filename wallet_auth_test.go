@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestKeccak256(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"", "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"},
+		{"abc", "4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45"},
+		{"The quick brown fox jumps over the lazy dog", "4d741b6f1eb29cb2a9b9911c82f56fa8d73b04959d3d9d222895df6c0b28aa15"},
+		// One byte short of the rate, exactly the rate and two blocks
+		{strings.Repeat("a", 135), "34367dc248bbd832f4e3e69dfaac2f92638bd0bbd18f2912ba4ef454919cf446"},
+		{strings.Repeat("a", 136), "a6c4d403279fe3e0af03729caada8374b5ca54d8065329a3ebcaeb4b60aa386e"},
+		{strings.Repeat("a", 200), "96ea54061def936c4be90b518992fdc6f12f535068a256229aca54267b4d084d"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(keccak256([]byte(tt.input))); got != tt.want {
+			t.Errorf("keccak256(%d bytes) = %s; want %s", len(tt.input), got, tt.want)
+		}
+	}
+	split := hex.EncodeToString(keccak256([]byte(strings.Repeat("a", 100)), []byte(strings.Repeat("a", 100))))
+	if split != tests[5].want {
+		t.Errorf("keccak256 of split input = %s", split)
+	}
+	if got := hex.EncodeToString(keccak256([]byte("transfer(address,uint256)"))[:4]); got != "a9059cbb" {
+		t.Errorf("transfer selector = %s", got)
+	}
+}
+
+func TestChecksumAddress(t *testing.T) {
+	// EIP-55 test vectors
+	for _, want := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	} {
+		if got := checksumAddress(strings.ToLower(want)); got != want {
+			t.Errorf("checksumAddress(%s) = %s", strings.ToLower(want), got)
+		}
+		if got := checksumAddress(strings.ToUpper(want[2:])); got != want {
+			t.Errorf("checksumAddress(%s) = %s", strings.ToUpper(want[2:]), got)
+		}
+	}
+}
+
+// testSign makes a recoverable ECDSA signature of hash with private key d
+// and nonce k.
+func testSign(hash []byte, d, k int64) []byte {
+	R := ecMul(ecPoint{secp256k1Gx, secp256k1Gy}, big.NewInt(k))
+	r := new(big.Int).Mod(R.x, secp256k1N)
+	s := new(big.Int).Mul(r, big.NewInt(d))
+	s.Add(s, new(big.Int).SetBytes(hash))
+	s.Mul(s, new(big.Int).ModInverse(big.NewInt(k), secp256k1N))
+	s.Mod(s, secp256k1N)
+	signature := make([]byte, 65)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:64])
+	signature[64] = 27 + byte(R.y.Bit(0))
+	return signature
+}
+
+func TestEcrecoverAddress(t *testing.T) {
+	hash := keccak256([]byte("\x19Ethereum Signed Message:\n5hello"))
+	tests := []struct {
+		key, nonce int64
+		want       string
+	}{
+		{1, 7, "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf"},
+		{2, 11, "0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF"},
+		{3, 1234567, "0x6813Eb9362372EEF6200f3b1dbC3f819671cBA69"},
+	}
+	for _, tt := range tests {
+		signature := testSign(hash, tt.key, tt.nonce)
+		got, err := ecrecoverAddress(hash, signature)
+		if err != nil || !strings.EqualFold(got, tt.want) {
+			t.Errorf("key %d: ecrecoverAddress = %s, %v; want %s", tt.key, got, err, tt.want)
+		}
+		// v given as 0/1 recovers the same address
+		signature[64] -= 27
+		if got, err := ecrecoverAddress(hash, signature); err != nil || !strings.EqualFold(got, tt.want) {
+			t.Errorf("key %d with v = %d: %s, %v", tt.key, signature[64], got, err)
+		}
+		// Another message recovers another signer
+		if got, _ := ecrecoverAddress(keccak256([]byte("other")), signature); strings.EqualFold(got, tt.want) {
+			t.Errorf("key %d: signature valid for another message", tt.key)
+		}
+	}
+
+	signature := testSign(hash, 1, 7)
+	for name, bad := range map[string]func([]byte){
+		"v out of range": func(s []byte) { s[64] = 29 },
+		"zero r":         func(s []byte) { copy(s[:32], make([]byte, 32)) },
+		"zero s":         func(s []byte) { copy(s[32:64], make([]byte, 32)) },
+		"s too large":    func(s []byte) { secp256k1N.FillBytes(s[32:64]) },
+	} {
+		s := append([]byte(nil), signature...)
+		bad(s)
+		if _, err := ecrecoverAddress(hash, s); err != errInvalidSignature {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := ecrecoverAddress(hash, signature[:64]); err != errInvalidSignature {
+		t.Errorf("short signature: %v", err)
+	}
+}
+
+func TestValidateWalletAuthConfig(t *testing.T) {
+	c, nft := defaultWalletAuthConfig(), defaultNFTConfig()
+	if err := validateWalletAuthConfig(c, nft); err == nil {
+		t.Error("missing domain accepted")
+	}
+	if err := validateWalletAuthConfig(c, NFTConfig{}); err != nil {
+		t.Errorf("domain required without NFT collections: %v", err)
+	}
+	c.Domain = "https://fx.land/"
+	if err := validateWalletAuthConfig(c, nft); err == nil {
+		t.Error("URL accepted as domain")
+	}
+	c.Domain = "fx.land"
+	if err := validateWalletAuthConfig(c, nft); err != nil {
+		t.Errorf("domain refused: %v", err)
+	}
+}